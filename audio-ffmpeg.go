@@ -0,0 +1,320 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"layeh.com/gopus"
+)
+
+var (
+	// ffmpegPath and ffprobePath locate the binaries used to decode audio
+	// that is not already Opus.
+	ffmpegPath  = "ffmpeg"
+	ffprobePath = "ffprobe"
+)
+
+const (
+	// opusFrameSize is the number of samples per channel in a 20ms frame.
+	opusFrameSize     = 960
+	opusFrameDuration = 20 * time.Millisecond
+)
+
+// ffmpegStream decodes any input ffmpeg understands to 48kHz stereo PCM and
+// encodes it to Opus frames. Seeking restarts ffmpeg at the new position.
+type ffmpegStream struct {
+	input string
+	// open returns the data to pipe into ffmpeg when input is read from
+	// stdin. It is called again each time ffmpeg is restarted.
+	open      func() (io.ReadCloser, error)
+	encoder   *gopus.Encoder
+	packets   chan OpusPacket
+	seek      chan time.Duration
+	done      chan bool
+	closeOnce sync.Once
+
+	mu   sync.Mutex
+	cmd  *exec.Cmd
+	pipe io.ReadCloser
+	err  error
+}
+
+// newFFmpegStream starts transcoding input, which may be a file path or URL.
+func newFFmpegStream(input string) (*ffmpegStream, error) {
+	return startFFmpegStream(&ffmpegStream{input: input})
+}
+
+// newFFmpegPipeStream starts transcoding the data returned by open, which is
+// piped into ffmpeg as it is read. As the pipe cannot seek, formats that keep
+// their index at the end of the file cannot be played this way.
+func newFFmpegPipeStream(open func() (io.ReadCloser, error)) (*ffmpegStream, error) {
+	return startFFmpegStream(&ffmpegStream{input: "pipe:0", open: open})
+}
+
+func startFFmpegStream(s *ffmpegStream) (*ffmpegStream, error) {
+	encoder, err := gopus.NewEncoder(opusSampleRate, opusChannels, gopus.Audio)
+	if err != nil {
+		return nil, err
+	}
+
+	s.encoder = encoder
+	s.packets = make(chan OpusPacket)
+	s.seek = make(chan time.Duration, 1)
+	s.done = make(chan bool)
+
+	stdout, err := s.start(0)
+	if err != nil {
+		return nil, err
+	}
+
+	go s.run(stdout)
+
+	return s, nil
+}
+
+func (s *ffmpegStream) Packets() <-chan OpusPacket {
+	return s.packets
+}
+
+func (s *ffmpegStream) Seek(position time.Duration) {
+	// Only the latest request matters.
+	select {
+	case <-s.seek:
+	default:
+	}
+	s.seek <- position
+}
+
+func (s *ffmpegStream) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.err
+}
+
+func (s *ffmpegStream) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.done)
+		s.stop()
+	})
+	return nil
+}
+
+func (s *ffmpegStream) start(position time.Duration) (io.Reader, error) {
+	args := []string{"-hide_banner", "-loglevel", "error"}
+	if position > 0 {
+		args = append(args, "-ss", strconv.FormatFloat(position.Seconds(), 'f', 3, 64))
+	}
+	args = append(args,
+		"-i", s.input,
+		"-vn",
+		"-f", "s16le",
+		"-ar", strconv.Itoa(opusSampleRate),
+		"-ac", strconv.Itoa(opusChannels),
+		"pipe:1",
+	)
+
+	cmd := exec.Command(ffmpegPath, args...)
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+
+	var stdin io.WriteCloser
+	var pipe io.ReadCloser
+	if s.open != nil {
+		if stdin, err = cmd.StdinPipe(); err != nil {
+			return nil, err
+		}
+		if pipe, err = s.open(); err != nil {
+			stdin.Close()
+			return nil, err
+		}
+	}
+
+	if err := cmd.Start(); err != nil {
+		if pipe != nil {
+			pipe.Close()
+		}
+		return nil, fmt.Errorf("failed to start ffmpeg: %w", err)
+	}
+
+	s.mu.Lock()
+	s.cmd = cmd
+	s.pipe = pipe
+	s.mu.Unlock()
+
+	if pipe != nil {
+		go s.feed(stdin, pipe)
+	}
+
+	return bufio.NewReaderSize(stdout, 16384), nil
+}
+
+// feed copies pipe to ffmpeg's stdin until it runs out or either side is
+// closed. An error reading pipe, such as a failed download, ends the stream
+// with that error.
+func (s *ffmpegStream) feed(stdin io.WriteCloser, pipe io.Reader) {
+	defer stdin.Close()
+
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := pipe.Read(buf)
+		if n > 0 {
+			if _, err := stdin.Write(buf[:n]); err != nil {
+				// ffmpeg has exited or stopped reading.
+				return
+			}
+		}
+
+		if err != nil {
+			if err != io.EOF && err != errReaderClosed {
+				s.setErr(err)
+			}
+			return
+		}
+	}
+}
+
+func (s *ffmpegStream) stop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.cmd != nil {
+		s.cmd.Process.Kill()
+		s.closePipe()
+		s.cmd.Wait()
+		s.cmd = nil
+	}
+}
+
+// closePipe closes the data being fed to ffmpeg, which unblocks a feed that
+// is waiting for more of a download. The caller must hold mu.
+func (s *ffmpegStream) closePipe() {
+	if s.pipe != nil {
+		s.pipe.Close()
+		s.pipe = nil
+	}
+}
+
+// wait waits for ffmpeg to exit after it has closed its output, and records
+// why it failed if it did.
+func (s *ffmpegStream) wait() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.cmd == nil {
+		return
+	}
+
+	s.closePipe()
+	if err := s.cmd.Wait(); err != nil && s.err == nil {
+		s.err = fmt.Errorf("ffmpeg failed: %w", err)
+	}
+	s.cmd = nil
+}
+
+// setErr records why the stream ended, keeping the first error.
+func (s *ffmpegStream) setErr(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.err == nil {
+		s.err = err
+	}
+}
+
+func (s *ffmpegStream) run(stdout io.Reader) {
+	defer close(s.packets)
+	defer s.stop()
+
+	pcm := make([]int16, opusFrameSize*opusChannels)
+	var position time.Duration
+
+	for {
+		// A trailing partial frame is shorter than 20ms and is dropped.
+		if err := binary.Read(stdout, binary.LittleEndian, pcm); err != nil {
+			s.wait()
+			return
+		}
+
+		frame, err := s.encoder.Encode(pcm, opusFrameSize, opusMaxDataBytes)
+		if err != nil {
+			s.setErr(err)
+			return
+		}
+
+		select {
+		case s.packets <- OpusPacket{Data: frame, Timecode: position}:
+			position += opusFrameDuration
+		case target := <-s.seek:
+			s.stop()
+			stdout, err = s.start(target)
+			if err != nil {
+				s.setErr(err)
+				return
+			}
+			position = target
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// audioProbe is the metadata read from a media file.
+type audioProbe struct {
+	Duration time.Duration
+	Title    string
+	Artist   string
+	Album    string
+}
+
+// probeAudio reads the duration and tags of input with ffprobe.
+func probeAudio(input string) (*audioProbe, error) {
+	out, err := exec.Command(ffprobePath,
+		"-v", "quiet",
+		"-print_format", "json",
+		"-show_format",
+		input,
+	).Output()
+	if err != nil {
+		return nil, fmt.Errorf("ffprobe failed: %w", err)
+	}
+
+	var data struct {
+		Format struct {
+			Duration string            `json:"duration"`
+			Tags     map[string]string `json:"tags"`
+		} `json:"format"`
+	}
+
+	if err := json.Unmarshal(out, &data); err != nil {
+		return nil, err
+	}
+
+	tags := make(map[string]string)
+	for k, v := range data.Format.Tags {
+		tags[strings.ToLower(k)] = v
+	}
+
+	probe := &audioProbe{
+		Title:  tags["title"],
+		Artist: tags["artist"],
+		Album:  tags["album"],
+	}
+
+	if seconds, err := strconv.ParseFloat(data.Format.Duration, 64); err == nil {
+		probe.Duration = time.Duration(seconds * float64(time.Second))
+	}
+
+	return probe, nil
+}
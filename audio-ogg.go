@@ -0,0 +1,273 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+var (
+	oggCapturePattern = []byte("OggS")
+	opusHeadMagic     = []byte("OpusHead")
+	opusTagsMagic     = []byte("OpusTags")
+)
+
+// oggStream demuxes Opus packets from an Ogg container. Seeking rescans the
+// file from the start, skipping whole pages by their granule position.
+type oggStream struct {
+	file io.ReadSeeker
+	// preSkip is the number of samples at the start of the stream that are
+	// counted by granule positions but not played.
+	preSkip   int64
+	packets   chan OpusPacket
+	seek      chan time.Duration
+	done      chan bool
+	closeOnce sync.Once
+
+	mu  sync.Mutex
+	err error
+}
+
+// oggPage is a single page of an Ogg bitstream. Packets holds the packet data
+// in the page; if continued is set the first entry finishes a packet started
+// on an earlier page, and if partial is set the last entry continues on the
+// next page.
+type oggPage struct {
+	granule   int64
+	continued bool
+	partial   bool
+	packets   [][]byte
+}
+
+func newOggStream(file io.ReadSeeker) (*oggStream, error) {
+	r := bufio.NewReader(file)
+
+	page, err := readOggPage(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(page.packets) == 0 || !bytes.HasPrefix(page.packets[0], opusHeadMagic) {
+		return nil, errUnsupportedAudio
+	}
+
+	head := page.packets[0]
+	if len(head) < 12 {
+		return nil, fmt.Errorf("invalid opus header")
+	}
+
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	s := &oggStream{
+		file:    file,
+		preSkip: int64(binary.LittleEndian.Uint16(head[10:12])),
+		packets: make(chan OpusPacket),
+		seek:    make(chan time.Duration, 1),
+		done:    make(chan bool),
+	}
+
+	go s.run()
+
+	return s, nil
+}
+
+func (s *oggStream) Packets() <-chan OpusPacket {
+	return s.packets
+}
+
+func (s *oggStream) Seek(position time.Duration) {
+	// Only the latest request matters.
+	select {
+	case <-s.seek:
+	default:
+	}
+	s.seek <- position
+}
+
+func (s *oggStream) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.done)
+	})
+	return nil
+}
+
+func (s *oggStream) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.err
+}
+
+func (s *oggStream) setErr(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.err = err
+}
+
+func (s *oggStream) run() {
+	defer func() {
+		if closer, ok := s.file.(io.Closer); ok {
+			closer.Close()
+		}
+	}()
+	defer close(s.packets)
+
+	r := bufio.NewReader(s.file)
+	var position, skipUntil time.Duration
+	var pending []byte
+
+pages:
+	for {
+		page, err := readOggPage(r)
+		if err != nil {
+			if err != io.EOF {
+				s.setErr(err)
+			}
+			return
+		}
+
+		// Skip pages that end before the seek target without looking at their
+		// packets. The granule position counts 48kHz samples, including the
+		// pre-skip.
+		end := time.Duration(page.granule-s.preSkip) * time.Second / opusSampleRate
+		if end < 0 {
+			end = 0
+		}
+		if page.granule >= 0 && end < skipUntil {
+			position = end
+			pending = nil
+			continue
+		}
+
+		for i, data := range page.packets {
+			if i == 0 && page.continued {
+				if pending == nil {
+					// The start of this packet was on a skipped page.
+					continue
+				}
+				data = append(pending, data...)
+			}
+			pending = nil
+
+			if i == len(page.packets)-1 && page.partial {
+				pending = append([]byte{}, data...)
+				continue
+			}
+
+			if bytes.HasPrefix(data, opusHeadMagic) || bytes.HasPrefix(data, opusTagsMagic) {
+				continue
+			}
+
+			duration := opusPacketDuration(data)
+			if position+duration <= skipUntil {
+				position += duration
+				continue
+			}
+
+			select {
+			case s.packets <- OpusPacket{Data: data, Timecode: position}:
+				position += duration
+			case target := <-s.seek:
+				if _, err := s.file.Seek(0, io.SeekStart); err != nil {
+					s.setErr(err)
+					return
+				}
+				r.Reset(s.file)
+				position, skipUntil, pending = 0, target, nil
+				continue pages
+			case <-s.done:
+				return
+			}
+		}
+	}
+}
+
+// readOggPage reads the next page from r.
+func readOggPage(r io.Reader) (*oggPage, error) {
+	header := make([]byte, 27)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+
+	if !bytes.Equal(header[:4], oggCapturePattern) {
+		return nil, fmt.Errorf("invalid ogg page")
+	}
+
+	page := &oggPage{
+		granule:   int64(binary.LittleEndian.Uint64(header[6:14])),
+		continued: header[5]&0x01 != 0,
+	}
+
+	segments := make([]byte, header[26])
+	if _, err := io.ReadFull(r, segments); err != nil {
+		return nil, err
+	}
+
+	size := 0
+	for _, s := range segments {
+		size += int(s)
+	}
+
+	data := make([]byte, size)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+
+	// Packets are split into 255 byte lacing values; a shorter value ends the
+	// packet. A page ending on 255 continues its last packet on the next page.
+	start, offset := 0, 0
+	for i, s := range segments {
+		offset += int(s)
+		if s < 255 {
+			page.packets = append(page.packets, data[start:offset])
+			start = offset
+		} else if i == len(segments)-1 {
+			page.packets = append(page.packets, data[start:offset])
+			page.partial = true
+		}
+	}
+
+	return page, nil
+}
+
+// opusPacketDuration reads the length of an Opus packet from its TOC byte as
+// described in RFC 6716 section 3.1.
+func opusPacketDuration(packet []byte) time.Duration {
+	if len(packet) == 0 {
+		return 0
+	}
+
+	config := packet[0] >> 3
+
+	var frame time.Duration
+	switch {
+	case config < 12:
+		// SILK: 10, 20, 40 or 60ms
+		frame = []time.Duration{10, 20, 40, 60}[config%4] * time.Millisecond
+	case config < 16:
+		// Hybrid: 10 or 20ms
+		frame = []time.Duration{10, 20}[config%2] * time.Millisecond
+	default:
+		// CELT: 2.5, 5, 10 or 20ms
+		frame = []time.Duration{2500, 5000, 10000, 20000}[config%4] * time.Microsecond
+	}
+
+	frames := 1
+	switch packet[0] & 0x03 {
+	case 1, 2:
+		frames = 2
+	case 3:
+		if len(packet) > 1 {
+			frames = int(packet[1] & 0x3f)
+		}
+	}
+
+	return frame * time.Duration(frames)
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func openTestOgg(t *testing.T) *oggStream {
+	stream, err := newOggStream(bytes.NewReader(readTestData(t, "tone.opus")))
+	if err != nil {
+		t.Fatalf("newOggStream: %v", err)
+	}
+	t.Cleanup(func() {
+		stream.Close()
+	})
+	return stream
+}
+
+func TestOggStreamPackets(t *testing.T) {
+	stream := openTestOgg(t)
+
+	count := 0
+	for packet := range stream.Packets() {
+		if want := time.Duration(count) * opusFrameDuration; packet.Timecode != want {
+			t.Errorf("packet %v timecode = %v, want %v", count, packet.Timecode, want)
+		}
+		if len(packet.Data) == 0 {
+			t.Errorf("packet %v is empty", count)
+		}
+		count++
+	}
+
+	if err := stream.Err(); err != nil {
+		t.Fatalf("stream ended with %v", err)
+	}
+	// The headers are not sent as packets.
+	if count != 50 {
+		t.Errorf("got %v packets, want 50", count)
+	}
+}
+
+func TestOggStreamSeek(t *testing.T) {
+	stream := openTestOgg(t)
+
+	if _, ok := receivePacket(t, stream); !ok {
+		t.Fatal("stream ended before the first packet")
+	}
+
+	stream.Seek(500 * time.Millisecond)
+
+	// The packet after the first may already be on its way when the seek
+	// is picked up.
+	packet, ok := receivePacket(t, stream)
+	if ok && packet.Timecode == opusFrameDuration {
+		packet, ok = receivePacket(t, stream)
+	}
+	if !ok {
+		t.Fatal("stream ended after seeking")
+	}
+	if packet.Timecode != 500*time.Millisecond {
+		t.Fatalf("first packet after seeking is at %v, want 500ms", packet.Timecode)
+	}
+
+	count := 1
+	for packet := range stream.Packets() {
+		if want := 500*time.Millisecond + time.Duration(count)*opusFrameDuration; packet.Timecode != want {
+			t.Errorf("packet %v after seeking is at %v, want %v", count, packet.Timecode, want)
+		}
+		count++
+	}
+
+	if err := stream.Err(); err != nil {
+		t.Fatalf("stream ended with %v", err)
+	}
+	if count != 25 {
+		t.Errorf("got %v packets after seeking, want 25", count)
+	}
+}
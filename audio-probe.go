@@ -0,0 +1,329 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+const (
+	// probeHeadSize is how much of the start of a file is read to find its
+	// duration and title, and probeTailSize how much of the end of an Ogg
+	// file is read to find its last granule position.
+	probeHeadSize = 64 << 10
+	probeTailSize = 64 << 10
+	// probeFrameSize is how much is read after an ID3 tag that does not fit
+	// in the head to find the first MP3 frame.
+	probeFrameSize = 4 << 10
+)
+
+const (
+	ebmlSegmentID       = 0x18538067
+	ebmlInfoID          = 0x1549a966
+	ebmlClusterID       = 0x1f43b675
+	ebmlTimecodeScaleID = 0x2ad7b1
+	ebmlDurationID      = 0x4489
+	ebmlTitleID         = 0x7ba9
+)
+
+var id3Magic = []byte("ID3")
+
+// probeWebm reads the duration and title from the segment info at the start
+// of a WebM file.
+func probeWebm(head []byte) *audioProbe {
+	probe := &audioProbe{}
+	scale := uint64(1000000)
+	var duration float64
+
+	for pos := 0; pos < len(head); {
+		id, n := readEBMLID(head[pos:])
+		if n == 0 {
+			break
+		}
+		size, m, known := readEBMLSize(head[pos+n:])
+		if m == 0 {
+			break
+		}
+		pos += n + m
+
+		// The info is inside the segment, and the audio starts at the first
+		// cluster.
+		if id == ebmlSegmentID || id == ebmlInfoID {
+			continue
+		}
+		if id == ebmlClusterID || !known || size > uint64(len(head)-pos) {
+			break
+		}
+
+		value := head[pos : pos+int(size)]
+		switch id {
+		case ebmlTimecodeScaleID:
+			scale = readBigEndian(value)
+		case ebmlDurationID:
+			switch len(value) {
+			case 4:
+				duration = float64(math.Float32frombits(binary.BigEndian.Uint32(value)))
+			case 8:
+				duration = math.Float64frombits(binary.BigEndian.Uint64(value))
+			}
+		case ebmlTitleID:
+			probe.Title = string(value)
+		}
+		pos += int(size)
+	}
+
+	probe.Duration = time.Duration(duration * float64(scale))
+	return probe
+}
+
+// readEBMLID reads an element ID, which keeps its length marker. It returns
+// the length of the ID, or 0 if data is too short or invalid.
+func readEBMLID(data []byte) (uint32, int) {
+	if len(data) == 0 || data[0] == 0 {
+		return 0, 0
+	}
+
+	n := 1
+	for mask := byte(0x80); data[0]&mask == 0; mask >>= 1 {
+		n++
+	}
+	if n > 4 || n > len(data) {
+		return 0, 0
+	}
+
+	return uint32(readBigEndian(data[:n])), n
+}
+
+// readEBMLSize reads an element size. known is false for the reserved value
+// meaning the size is unknown.
+func readEBMLSize(data []byte) (size uint64, n int, known bool) {
+	if len(data) == 0 || data[0] == 0 {
+		return 0, 0, false
+	}
+
+	n = 1
+	for mask := byte(0x80); data[0]&mask == 0; mask >>= 1 {
+		n++
+	}
+	if n > len(data) {
+		return 0, 0, false
+	}
+
+	size = readBigEndian(data[:n]) &^ (1 << uint(7*n))
+	return size, n, size != 1<<uint(7*n)-1
+}
+
+func readBigEndian(data []byte) uint64 {
+	var v uint64
+	for _, b := range data {
+		v = v<<8 | uint64(b)
+	}
+	return v
+}
+
+// probeOggHead reads the title from the OpusTags of an Ogg Opus file and the
+// number of samples to skip at its start, which the granule positions count.
+func probeOggHead(head []byte) (probe *audioProbe, preSkip int64) {
+	probe = &audioProbe{}
+	r := bytes.NewReader(head)
+
+	var packet []byte
+	for {
+		page, err := readOggPage(r)
+		if err != nil {
+			return probe, preSkip
+		}
+
+		for i, data := range page.packets {
+			if i > 0 || !page.continued {
+				packet = nil
+			}
+			packet = append(packet, data...)
+			if i == len(page.packets)-1 && page.partial {
+				break
+			}
+
+			switch {
+			case bytes.HasPrefix(packet, opusHeadMagic) && len(packet) >= 12:
+				preSkip = int64(binary.LittleEndian.Uint16(packet[10:12]))
+			case bytes.HasPrefix(packet, opusTagsMagic):
+				tags := readVorbisComments(packet[len(opusTagsMagic):])
+				probe.Title = tags["title"]
+				probe.Artist = tags["artist"]
+				probe.Album = tags["album"]
+				return probe, preSkip
+			default:
+				// The tags come before any audio.
+				return probe, preSkip
+			}
+		}
+	}
+}
+
+// readVorbisComments reads the KEY=value comments of an OpusTags packet into
+// a map with lower case keys.
+func readVorbisComments(data []byte) map[string]string {
+	tags := make(map[string]string)
+
+	next := func() ([]byte, bool) {
+		if len(data) < 4 {
+			return nil, false
+		}
+		n := binary.LittleEndian.Uint32(data)
+		if uint64(n) > uint64(len(data)-4) {
+			return nil, false
+		}
+		value := data[4 : 4+n]
+		data = data[4+n:]
+		return value, true
+	}
+
+	// The vendor string comes first.
+	if _, ok := next(); !ok || len(data) < 4 {
+		return tags
+	}
+	count := binary.LittleEndian.Uint32(data)
+	data = data[4:]
+
+	for i := uint32(0); i < count; i++ {
+		comment, ok := next()
+		if !ok {
+			break
+		}
+		if parts := strings.SplitN(string(comment), "=", 2); len(parts) == 2 {
+			tags[strings.ToLower(parts[0])] = parts[1]
+		}
+	}
+
+	return tags
+}
+
+// oggLastGranule returns the granule position of the last complete page
+// header in tail, or -1 if there is none.
+func oggLastGranule(tail []byte) int64 {
+	for i := bytes.LastIndex(tail, oggCapturePattern); i >= 0; i = bytes.LastIndex(tail[:i], oggCapturePattern) {
+		if len(tail)-i < 27 || tail[i+4] != 0 {
+			continue
+		}
+		if granule := int64(binary.LittleEndian.Uint64(tail[i+6 : i+14])); granule >= 0 {
+			return granule
+		}
+	}
+	return -1
+}
+
+// probeID3 reads the title from the ID3v2 tag at the start of an MP3 file, if
+// it has one, and returns where the tag ends.
+func probeID3(head []byte) (probe *audioProbe, tagEnd int64) {
+	probe = &audioProbe{}
+	if len(head) < 10 || !bytes.HasPrefix(head, id3Magic) {
+		return probe, 0
+	}
+
+	version := head[3]
+	tagEnd = 10 + int64(syncsafe(head[6:10]))
+	if head[5]&0x10 != 0 {
+		// A footer repeats the header at the end of the tag.
+		tagEnd += 10
+	}
+
+	frames := head[10:]
+	if int64(len(frames)) > tagEnd-10 {
+		frames = frames[:tagEnd-10]
+	}
+
+	for len(frames) >= 10 && frames[0] != 0 {
+		id := string(frames[:4])
+		size := int64(binary.BigEndian.Uint32(frames[4:8]))
+		if version >= 4 {
+			size = int64(syncsafe(frames[4:8]))
+		}
+		if size > int64(len(frames)-10) {
+			break
+		}
+
+		value := frames[10 : 10+size]
+		switch id {
+		case "TIT2":
+			probe.Title = decodeID3Text(value)
+		case "TPE1":
+			probe.Artist = decodeID3Text(value)
+		case "TALB":
+			probe.Album = decodeID3Text(value)
+		}
+		frames = frames[10+size:]
+	}
+
+	return probe, tagEnd
+}
+
+func syncsafe(b []byte) uint32 {
+	return uint32(b[0]&0x7f)<<21 | uint32(b[1]&0x7f)<<14 | uint32(b[2]&0x7f)<<7 | uint32(b[3]&0x7f)
+}
+
+// decodeID3Text decodes a text frame, whose first byte gives the encoding.
+func decodeID3Text(value []byte) string {
+	if len(value) == 0 {
+		return ""
+	}
+
+	text := value[1:]
+	switch value[0] {
+	case 0:
+		runes := make([]rune, len(text))
+		for i, b := range text {
+			runes[i] = rune(b)
+		}
+		return strings.TrimRight(string(runes), "\x00")
+	case 1, 2:
+		bigEndian := value[0] == 2
+		if len(text) >= 2 && text[0] == 0xfe && text[1] == 0xff {
+			bigEndian, text = true, text[2:]
+		} else if len(text) >= 2 && text[0] == 0xff && text[1] == 0xfe {
+			bigEndian, text = false, text[2:]
+		}
+
+		units := make([]uint16, len(text)/2)
+		for i := range units {
+			if bigEndian {
+				units[i] = binary.BigEndian.Uint16(text[2*i:])
+			} else {
+				units[i] = binary.LittleEndian.Uint16(text[2*i:])
+			}
+		}
+		return strings.TrimRight(string(utf16.Decode(units)), "\x00")
+	}
+
+	return strings.TrimRight(string(text), "\x00")
+}
+
+var (
+	mp3BitratesV1 = []int{0, 32, 40, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320}
+	mp3BitratesV2 = []int{0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160}
+)
+
+// mp3Bitrate returns the bitrate in bits per second of the first MPEG layer
+// III frame in data, or 0 if none is found.
+func mp3Bitrate(data []byte) int {
+	for i := 0; i+4 <= len(data); i++ {
+		if data[i] != 0xff || data[i+1]&0xe0 != 0xe0 {
+			continue
+		}
+
+		version := (data[i+1] >> 3) & 0x03
+		layer := (data[i+1] >> 1) & 0x03
+		index := int(data[i+2] >> 4)
+		if version == 1 || layer != 1 || index == 0 || index >= len(mp3BitratesV1) {
+			continue
+		}
+
+		if version == 3 {
+			return mp3BitratesV1[index] * 1000
+		}
+		return mp3BitratesV2[index] * 1000
+	}
+	return 0
+}
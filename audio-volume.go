@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+
+	"layeh.com/gopus"
+)
+
+const (
+	opusSampleRate = 48000
+	opusChannels   = 2
+	// opusMaxFrameSize is the largest frame Opus allows, 120ms at 48kHz.
+	opusMaxFrameSize = 5760
+	opusMaxDataBytes = 4000
+
+	defaultVolume = 100
+	maxVolume     = 200
+)
+
+// checkVolume makes sure volume is a percentage the gain stage supports.
+func checkVolume(volume int) error {
+	if volume < 0 || volume > maxVolume {
+		return fmt.Errorf("volume must be between 0 and %v", maxVolume)
+	}
+	return nil
+}
+
+// gainProcessor changes the loudness of an Opus stream by decoding each frame
+// to PCM, scaling the samples and encoding the result again. Decoder and
+// encoder state carries over between frames, so one processor must be used
+// for a single continuous stream.
+type gainProcessor struct {
+	decoder *gopus.Decoder
+	encoder *gopus.Encoder
+}
+
+func newGainProcessor() (*gainProcessor, error) {
+	decoder, err := gopus.NewDecoder(opusSampleRate, opusChannels)
+	if err != nil {
+		return nil, err
+	}
+
+	encoder, err := gopus.NewEncoder(opusSampleRate, opusChannels, gopus.Audio)
+	if err != nil {
+		return nil, err
+	}
+
+	return &gainProcessor{
+		decoder: decoder,
+		encoder: encoder,
+	}, nil
+}
+
+// Process returns frame re-encoded at volume percent of its original level.
+func (g *gainProcessor) Process(frame []byte, volume int) ([]byte, error) {
+	pcm, err := g.decoder.Decode(frame, opusMaxFrameSize, false)
+	if err != nil {
+		return nil, err
+	}
+
+	applyGain(pcm, volume)
+
+	return g.encoder.Encode(pcm, len(pcm)/opusChannels, opusMaxDataBytes)
+}
+
+// applyGain scales pcm in place by volume percent, clipping at the int16 range.
+func applyGain(pcm []int16, volume int) {
+	for i, sample := range pcm {
+		v := int32(sample) * int32(volume) / 100
+		if v > 32767 {
+			v = 32767
+		} else if v < -32768 {
+			v = -32768
+		}
+		pcm[i] = int16(v)
+	}
+}
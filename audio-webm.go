@@ -0,0 +1,156 @@
+package main
+
+import (
+	"io"
+	"sync"
+	"time"
+
+	"github.com/ebml-go/webm"
+)
+
+// webmStream adapts a webm.Reader to AudioStream.
+type webmStream struct {
+	file      io.Closer
+	input     *webmInput
+	reader    *webm.Reader
+	packets   chan OpusPacket
+	done      chan bool
+	closeOnce sync.Once
+}
+
+func newWebmStream(file io.ReadSeeker) (*webmStream, error) {
+	input := &webmInput{ReadSeeker: file}
+
+	var w webm.WebM
+	reader, err := webm.Parse(input, &w)
+	if err != nil {
+		return nil, err
+	}
+	if reader == nil {
+		return nil, errUnsupportedAudio
+	}
+
+	if track := w.FindFirstAudioTrack(); track == nil || track.CodecID != "A_OPUS" {
+		go func() {
+			for range reader.Chan {
+			}
+		}()
+		reader.Shutdown()
+		return nil, errUnsupportedAudio
+	}
+
+	s := &webmStream{
+		input:   input,
+		reader:  reader,
+		packets: make(chan OpusPacket),
+		done:    make(chan bool),
+	}
+	if closer, ok := file.(io.Closer); ok {
+		s.file = closer
+	}
+
+	go s.forward()
+
+	return s, nil
+}
+
+func (s *webmStream) Packets() <-chan OpusPacket {
+	return s.packets
+}
+
+func (s *webmStream) Seek(position time.Duration) {
+	s.reader.Seek(position)
+}
+
+// Err reports why the file could not be read to its end. The webm reader
+// stops on read errors without saying why, so they are taken from the input.
+func (s *webmStream) Err() error {
+	return s.input.Err()
+}
+
+func (s *webmStream) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.done)
+	})
+	return nil
+}
+
+// forward copies audio frames from the webm reader until the end of the file
+// or Close, then shuts the reader down.
+func (s *webmStream) forward() {
+	defer s.shutdown()
+	defer close(s.packets)
+
+	for {
+		select {
+		case packet, ok := <-s.reader.Chan:
+			// The end of the file is marked by a packet without data. Laced
+			// frames after the first also carry BadTC but do have data.
+			if !ok || (packet.Timecode == webm.BadTC && len(packet.Data) == 0) {
+				return
+			}
+
+			// Seeking emits a marker packet with no audio data.
+			if len(packet.Data) == 0 {
+				continue
+			}
+
+			timecode := packet.Timecode
+			if timecode == webm.BadTC {
+				timecode = -1
+			}
+
+			select {
+			case s.packets <- OpusPacket{Data: packet.Data, Timecode: timecode}:
+			case <-s.done:
+				return
+			}
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// shutdown stops the reader's parsing goroutine. The reader may be blocked
+// sending a packet, so its channel is drained until the goroutine closes it,
+// and only then is the file closed.
+func (s *webmStream) shutdown() {
+	go func() {
+		for range s.reader.Chan {
+		}
+
+		if s.file != nil {
+			s.file.Close()
+		}
+	}()
+
+	s.reader.Shutdown()
+}
+
+// webmInput passes reads through to the file being demuxed and keeps the
+// first error other than io.EOF.
+type webmInput struct {
+	io.ReadSeeker
+
+	mu  sync.Mutex
+	err error
+}
+
+func (r *webmInput) Read(p []byte) (int, error) {
+	n, err := r.ReadSeeker.Read(p)
+	if err != nil && err != io.EOF {
+		r.mu.Lock()
+		if r.err == nil {
+			r.err = err
+		}
+		r.mu.Unlock()
+	}
+	return n, err
+}
+
+func (r *webmInput) Err() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.err
+}
@@ -1,347 +1,1262 @@
-package main
-
-import (
-	"fmt"
-	"strings"
-	"time"
-
-	"github.com/bwmarrin/discordgo"
-	"github.com/lampjaw/discordgobot"
-)
-
-type MusicPlugin struct {
-	discordgobot.Plugin
-	player *MusicPlayer
-}
-
-func NewMusicPlugin() discordgobot.IPlugin {
-	return &MusicPlugin{}
-}
-
-func (p *MusicPlugin) Name() string {
-	return "Music"
-}
-
-func (p *MusicPlugin) Commands() []*discordgobot.CommandDefinition {
-	return []*discordgobot.CommandDefinition{
-		&discordgobot.CommandDefinition{
-			CommandID: "music-play",
-			Triggers: []string{
-				"play",
-			},
-			Arguments: []discordgobot.CommandDefinitionArgument{
-				discordgobot.CommandDefinitionArgument{
-					Optional: false,
-					Pattern:  ".+",
-					Alias:    "url",
-				},
-			},
-			Description: "Plays a song or playlist with the given url",
-			Callback:    p.runPlayMusicCommand,
-		},
-		&discordgobot.CommandDefinition{
-			CommandID: "music-disconnect",
-			Triggers: []string{
-				"disconnect",
-				"dc",
-			},
-			Description: "Disconnect the bot from the voice channel it is in",
-			Callback:    p.runDisconnectMusicCommand,
-		},
-		&discordgobot.CommandDefinition{
-			CommandID: "music-nowplaying",
-			Triggers: []string{
-				"nowplaying",
-				"np",
-			},
-			Description: "Shows what song the bot is currently playing",
-			Callback:    p.runNowPlayingMusicCommand,
-		},
-		&discordgobot.CommandDefinition{
-			CommandID: "music-skip",
-			Triggers: []string{
-				"skip",
-			},
-			Description: "Skips the currently playing song",
-			Callback:    p.runSkipMusicCommand,
-		},
-		&discordgobot.CommandDefinition{
-			CommandID: "music-remove",
-			Triggers: []string{
-				"remove",
-			},
-			Arguments: []discordgobot.CommandDefinitionArgument{
-				discordgobot.CommandDefinitionArgument{
-					Optional: false,
-					Pattern:  ".+",
-					Alias:    "videoID",
-				},
-			},
-			Description: "Removes a certain entry from the queue",
-			Callback:    p.runRemoveMusicCommand,
-		},
-		&discordgobot.CommandDefinition{
-			CommandID: "music-loopqueue",
-			Triggers: []string{
-				"loopqueue",
-				"lq",
-			},
-			Description: "Loops the whole queue",
-			Callback:    p.runLoopQueueMusicCommand,
-		},
-		&discordgobot.CommandDefinition{
-			CommandID: "music-loop",
-			Triggers: []string{
-				"loop",
-			},
-			Description: "Loop the currently playing song",
-			Callback:    p.runLoopMusicCommand,
-		},
-		&discordgobot.CommandDefinition{
-			CommandID: "music-resume",
-			Triggers: []string{
-				"resume",
-			},
-			Description: "Resume paused music",
-			Callback:    p.runResumeMusicCommand,
-		},
-		&discordgobot.CommandDefinition{
-			CommandID: "music-skipto",
-			Triggers: []string{
-				"skipto",
-			},
-			Arguments: []discordgobot.CommandDefinitionArgument{
-				discordgobot.CommandDefinitionArgument{
-					Optional: false,
-					Pattern:  ".+",
-					Alias:    "queuePosition",
-				},
-			},
-			Description: "Skips to a certain position in the queue",
-			Callback:    p.runSkipToMusicCommand,
-		},
-		&discordgobot.CommandDefinition{
-			CommandID: "music-clear",
-			Triggers: []string{
-				"clear",
-			},
-			Description: "Clears the queue",
-			Callback:    p.runClearMusicCommand,
-		},
-		&discordgobot.CommandDefinition{
-			CommandID: "music-replay",
-			Triggers: []string{
-				"replay",
-			},
-			Description: "Reset the progress of the current song",
-			Callback:    p.runReplayMusicCommand,
-		},
-		&discordgobot.CommandDefinition{
-			CommandID: "music-pause",
-			Triggers: []string{
-				"pause",
-			},
-			Description: "Pauses the currently playing track",
-			Callback:    p.runPauseMusicCommand,
-		},
-		&discordgobot.CommandDefinition{
-			CommandID: "music-removedupes",
-			Triggers: []string{
-				"removedupes",
-			},
-			Description: "Removes duplicate songs from the queue",
-			Callback:    p.runRemoveDupesMusicCommand,
-		},
-		&discordgobot.CommandDefinition{
-			CommandID: "music-shuffle",
-			Triggers: []string{
-				"shuffle",
-			},
-			Description: "Shuffles the queue",
-			Callback:    p.runShuffleMusicCommand,
-		},
-		&discordgobot.CommandDefinition{
-			CommandID: "music-queue",
-			Triggers: []string{
-				"queue",
-			},
-			Description: "View the queue",
-			Callback:    p.runQueueMusicCommand,
-		},
-	}
-}
-
-func (p *MusicPlugin) runPlayMusicCommand(bot *discordgobot.Gobot, client *discordgobot.DiscordClient, payload discordgobot.CommandPayload) {
-	userID := payload.Message.UserID()
-	guildID, _ := payload.Message.ResolveGuildID()
-
-	voiceState := findVoiceChannel(client.Session, guildID, userID)
-	if voiceState == nil {
-		client.SendMessage(payload.Message.Channel(), "You must be in a voice channel to use this command.")
-		return
-	}
-
-	if p.player == nil {
-		p.player = NewMusicPlayer()
-	}
-
-	if payload.Arguments["url"] != "" {
-		ytURL := payload.Arguments["url"]
-		if strings.Contains(ytURL, "playlist") {
-			playlist, _ := p.player.AddPlaylistToQueue(ytURL)
-
-			client.SendMessage(payload.Message.Channel(), fmt.Sprintf("Adding %v songs to the queue from `%s`", len(playlist.Items), playlist.Title))
-		} else {
-			vid, _ := p.player.AddSongToQueue(ytURL)
-
-			client.SendMessage(payload.Message.Channel(), fmt.Sprintf("Adding `%s` to the queue", vid.Title))
-		}
-	}
-
-	go p.playMusicInChannel(client.Session, voiceState.GuildID, voiceState.ChannelID)
-}
-
-func (p *MusicPlugin) runDisconnectMusicCommand(bot *discordgobot.Gobot, client *discordgobot.DiscordClient, payload discordgobot.CommandPayload) {
-	if p.player != nil {
-		p.player.Shutdown()
-		p.player = nil
-	}
-}
-
-func (p *MusicPlugin) runNowPlayingMusicCommand(bot *discordgobot.Gobot, client *discordgobot.DiscordClient, payload discordgobot.CommandPayload) {
-
-}
-
-func (p *MusicPlugin) runSkipMusicCommand(bot *discordgobot.Gobot, client *discordgobot.DiscordClient, payload discordgobot.CommandPayload) {
-	if p.player != nil {
-		p.player.Skip()
-	}
-}
-
-func (p *MusicPlugin) runRemoveMusicCommand(bot *discordgobot.Gobot, client *discordgobot.DiscordClient, payload discordgobot.CommandPayload) {
-
-}
-
-func (p *MusicPlugin) runLoopQueueMusicCommand(bot *discordgobot.Gobot, client *discordgobot.DiscordClient, payload discordgobot.CommandPayload) {
-	if p.player != nil {
-		p.player.loopQueue = !p.player.loopQueue
-		if p.player.loopQueue {
-			client.SendMessage(payload.Message.Channel(), "Queue looping enabled!")
-		} else {
-			client.SendMessage(payload.Message.Channel(), "Queue looping disabled")
-		}
-	}
-}
-
-func (p *MusicPlugin) runLoopMusicCommand(bot *discordgobot.Gobot, client *discordgobot.DiscordClient, payload discordgobot.CommandPayload) {
-	if p.player != nil {
-		p.player.loopSong = !p.player.loopSong
-		if p.player.loopSong {
-			client.SendMessage(payload.Message.Channel(), "Song looping enabled!")
-		} else {
-			client.SendMessage(payload.Message.Channel(), "Song looping enabled!")
-		}
-	}
-}
-
-func (p *MusicPlugin) runResumeMusicCommand(bot *discordgobot.Gobot, client *discordgobot.DiscordClient, payload discordgobot.CommandPayload) {
-	if p.player != nil {
-		guildID, _ := payload.Message.ResolveGuildID()
-		userID := payload.Message.UserID()
-
-		voiceState := findVoiceChannel(client.Session, guildID, userID)
-		if voiceState == nil {
-			client.SendMessage(payload.Message.Channel(), "You must be in a voice channel to use this command.")
-			return
-		}
-
-		go p.playMusicInChannel(client.Session, voiceState.GuildID, voiceState.ChannelID)
-	}
-}
-
-func (p *MusicPlugin) runSkipToMusicCommand(bot *discordgobot.Gobot, client *discordgobot.DiscordClient, payload discordgobot.CommandPayload) {
-
-}
-
-func (p *MusicPlugin) runClearMusicCommand(bot *discordgobot.Gobot, client *discordgobot.DiscordClient, payload discordgobot.CommandPayload) {
-	if p.player != nil {
-		p.player.ClearQueue()
-		client.SendMessage(payload.Message.Channel(), "Queue cleared!")
-	}
-}
-
-func (p *MusicPlugin) runReplayMusicCommand(bot *discordgobot.Gobot, client *discordgobot.DiscordClient, payload discordgobot.CommandPayload) {
-	if p.player != nil {
-		p.player.Replay()
-	}
-}
-
-func (p *MusicPlugin) runPauseMusicCommand(bot *discordgobot.Gobot, client *discordgobot.DiscordClient, payload discordgobot.CommandPayload) {
-
-}
-
-func (p *MusicPlugin) runRemoveDupesMusicCommand(bot *discordgobot.Gobot, client *discordgobot.DiscordClient, payload discordgobot.CommandPayload) {
-	if p.player != nil {
-		p.player.RemoveDuplicates()
-		client.SendMessage(payload.Message.Channel(), "Duplicates removed!")
-	}
-}
-
-func (p *MusicPlugin) runShuffleMusicCommand(bot *discordgobot.Gobot, client *discordgobot.DiscordClient, payload discordgobot.CommandPayload) {
-	if p.player != nil {
-		p.player.Shuffle()
-		client.SendMessage(payload.Message.Channel(), "Songs shuffled!")
-	}
-}
-
-func (p *MusicPlugin) runQueueMusicCommand(bot *discordgobot.Gobot, client *discordgobot.DiscordClient, payload discordgobot.CommandPayload) {
-	var sb strings.Builder
-
-	np := p.player.ActiveSong
-
-	sb.WriteString("Now Playing:\n")
-	sb.WriteString(fmt.Sprintf("`%s | %v`", np.Title, np.Duration))
-	sb.WriteString("\n\nUpNext\n")
-
-	var totalDuration time.Duration
-	rowCount := 1
-	for i, s := range p.player.SongQueue {
-		if rowCount < 11 && !(i == 0 && s.VideoID == np.VideoID) {
-			sb.WriteString(fmt.Sprintf("`%v. %s | %v`\n", rowCount, s.Title, s.Duration))
-			rowCount++
-		}
-
-		totalDuration += s.Duration
-	}
-
-	sb.WriteString(fmt.Sprintf("\n\n**%v songs in queue | %v total length**", len(p.player.SongQueue), totalDuration))
-
-	embed := &discordgo.MessageEmbed{
-		Title:       "Queue",
-		Color:       0x070707,
-		Description: sb.String(),
-	}
-
-	client.SendEmbedMessage(payload.Message.Channel(), embed)
-}
-
-func findVoiceChannel(s *discordgo.Session, guildID string, userID string) *discordgo.VoiceState {
-	guild, _ := s.Guild(guildID)
-
-	for _, s := range guild.VoiceStates {
-		if s.UserID == userID {
-			return s
-		}
-	}
-
-	return nil
-}
-
-func (p *MusicPlugin) playMusicInChannel(s *discordgo.Session, guildID string, channelID string) {
-	if p.player.voiceConnection == nil {
-		vc, _ := s.ChannelVoiceJoin(guildID, channelID, false, true)
-		p.player.Join(vc)
-	}
-
-	p.player.Play()
-}
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/lampjaw/discordgobot"
+)
+
+const (
+	defaultIdleTimeout      = 5 * time.Minute
+	defaultMaxPlaylistItems = 1000
+	searchResultCount       = 5
+)
+
+// playlistMode is a guild's choice of what a link to a video within a
+// playlist queues.
+type playlistMode string
+
+const (
+	playlistModeAsk      playlistMode = "ask"
+	playlistModeVideo    playlistMode = "video"
+	playlistModePlaylist playlistMode = "playlist"
+)
+
+const (
+	reactionVideo    = "\u25b6\ufe0f"
+	reactionPlaylist = "\U0001f4c3"
+)
+
+// MusicPluginConfig holds the operational settings of the music plugin.
+type MusicPluginConfig struct {
+	// IdleTimeout is how long the bot stays in voice after the queue runs out.
+	// Defaults to 5 minutes.
+	IdleTimeout time.Duration
+	// LibraryDir is a directory of audio files that can be queued with
+	// file:<path>. The library is disabled when empty.
+	LibraryDir string
+	// MaxPlaylistItems is the most songs queued from one playlist. Defaults to
+	// 1000; a negative value loads playlists in full.
+	MaxPlaylistItems int
+	// CacheDir is where downloaded songs are kept. Defaults to tmp.
+	CacheDir string
+	// CacheSize is the most disk space in bytes that downloaded songs may use
+	// before the least recently played are deleted. Defaults to 1 GiB.
+	CacheSize int64
+	// DataFile is where each guild's playlist mode and volume are saved so
+	// they survive a restart. They are only kept in memory when empty.
+	DataFile string
+	// Client makes the requests to YouTube and for direct links. Defaults to
+	// DefaultClient, which refuses to connect to private addresses; a
+	// replacement should do the same, as anyone can post a link.
+	Client *Client
+	// Sources are extra audio providers. They are consulted in order before
+	// the built in YouTube source.
+	Sources []Source
+}
+
+type MusicPlugin struct {
+	discordgobot.Plugin
+	config       MusicPluginConfig
+	sources      *SourceRegistry
+	cache        *SongCache
+	library      *LibrarySource
+	players      map[string]*MusicPlayer
+	textChannels map[string]string
+	idleTimers   map[string]*time.Timer
+	// volumes and histories hold each guild's volume and playback history,
+	// which outlive its players.
+	volumes   map[string]int
+	histories map[string]*PlayHistory
+	// playlistModes holds each guild's playlistMode; guilds without one are
+	// asked.
+	playlistModes map[string]playlistMode
+	prompts       map[string]*chatPrompt
+	// saveMu keeps saves from writing the data file at the same time.
+	saveMu sync.Mutex
+}
+
+func NewMusicPlugin(config *MusicPluginConfig) discordgobot.IPlugin {
+	p := &MusicPlugin{
+		players:      make(map[string]*MusicPlayer),
+		textChannels: make(map[string]string),
+		idleTimers:   make(map[string]*time.Timer),
+		volumes:      make(map[string]int),
+		histories:    make(map[string]*PlayHistory),
+
+		playlistModes: make(map[string]playlistMode),
+		prompts:       make(map[string]*chatPrompt),
+	}
+
+	if config != nil {
+		p.config = *config
+	}
+
+	if p.config.IdleTimeout <= 0 {
+		p.config.IdleTimeout = defaultIdleTimeout
+	}
+	if p.config.MaxPlaylistItems == 0 {
+		p.config.MaxPlaylistItems = defaultMaxPlaylistItems
+	} else if p.config.MaxPlaylistItems < 0 {
+		p.config.MaxPlaylistItems = 0
+	}
+	if p.config.Client == nil {
+		p.config.Client = DefaultClient
+	}
+	if p.config.CacheDir == "" {
+		p.config.CacheDir = defaultCacheDir
+	}
+	if p.config.CacheSize <= 0 {
+		p.config.CacheSize = defaultCacheSize
+	}
+
+	p.cache = NewSongCache(p.config.CacheDir, p.config.CacheSize)
+
+	p.sources = NewSourceRegistry(p.config.Sources...)
+	if p.config.LibraryDir != "" {
+		p.library = NewLibrarySource(p.config.LibraryDir)
+		p.sources.Register(p.library)
+	}
+	youtube := NewYouTubeSource(p.config.Client, p.cache, p.config.MaxPlaylistItems)
+	p.sources.Register(youtube)
+	p.sources.Register(NewHTTPSource(p.config.Client, p.cache))
+	p.sources.Register(NewYouTubeSearchSource(youtube, p.config.Client))
+
+	return p
+}
+
+func (p *MusicPlugin) Name() string {
+	return "Music"
+}
+
+func (p *MusicPlugin) Commands() []*discordgobot.CommandDefinition {
+	return []*discordgobot.CommandDefinition{
+		&discordgobot.CommandDefinition{
+			CommandID: "music-play",
+			Triggers: []string{
+				"play",
+			},
+			Arguments: []discordgobot.CommandDefinitionArgument{
+				discordgobot.CommandDefinitionArgument{
+					Optional: false,
+					Pattern:  ".+",
+					Alias:    "url",
+				},
+			},
+			Description: "Plays a song or playlist with the given url, file:<path> from the music library, or the top YouTube result for a search",
+			Callback:    p.runPlayMusicCommand,
+		},
+		&discordgobot.CommandDefinition{
+			CommandID: "music-search",
+			Triggers: []string{
+				"search",
+			},
+			Arguments: []discordgobot.CommandDefinitionArgument{
+				discordgobot.CommandDefinitionArgument{
+					Optional: false,
+					Pattern:  ".+",
+					Alias:    "query",
+				},
+			},
+			Description: "Searches YouTube and lets you pick which result to play",
+			Callback:    p.runSearchMusicCommand,
+		},
+		&discordgobot.CommandDefinition{
+			CommandID: "music-disconnect",
+			Triggers: []string{
+				"disconnect",
+				"dc",
+			},
+			Description: "Disconnect the bot from the voice channel it is in",
+			Callback:    p.runDisconnectMusicCommand,
+		},
+		&discordgobot.CommandDefinition{
+			CommandID: "music-nowplaying",
+			Triggers: []string{
+				"nowplaying",
+				"np",
+			},
+			Description: "Shows what song the bot is currently playing",
+			Callback:    p.runNowPlayingMusicCommand,
+		},
+		&discordgobot.CommandDefinition{
+			CommandID: "music-skip",
+			Triggers: []string{
+				"skip",
+			},
+			Description: "Skips the currently playing song",
+			Callback:    p.runSkipMusicCommand,
+		},
+		&discordgobot.CommandDefinition{
+			CommandID: "music-remove",
+			Triggers: []string{
+				"remove",
+			},
+			Arguments: []discordgobot.CommandDefinitionArgument{
+				discordgobot.CommandDefinitionArgument{
+					Optional: false,
+					Pattern:  ".+",
+					Alias:    "position",
+				},
+			},
+			Description: "Removes an entry or a range of entries (e.g. 3-7) from the queue",
+			Callback:    p.runRemoveMusicCommand,
+		},
+		&discordgobot.CommandDefinition{
+			CommandID: "music-loopqueue",
+			Triggers: []string{
+				"loopqueue",
+				"lq",
+			},
+			Description: "Loops the whole queue",
+			Callback:    p.runLoopQueueMusicCommand,
+		},
+		&discordgobot.CommandDefinition{
+			CommandID: "music-loop",
+			Triggers: []string{
+				"loop",
+			},
+			Description: "Loop the currently playing song",
+			Callback:    p.runLoopMusicCommand,
+		},
+		&discordgobot.CommandDefinition{
+			CommandID: "music-resume",
+			Triggers: []string{
+				"resume",
+			},
+			Description: "Resume paused music",
+			Callback:    p.runResumeMusicCommand,
+		},
+		&discordgobot.CommandDefinition{
+			CommandID: "music-skipto",
+			Triggers: []string{
+				"skipto",
+			},
+			Arguments: []discordgobot.CommandDefinitionArgument{
+				discordgobot.CommandDefinitionArgument{
+					Optional: false,
+					Pattern:  ".+",
+					Alias:    "queuePosition",
+				},
+			},
+			Description: "Skips to a certain position in the queue",
+			Callback:    p.runSkipToMusicCommand,
+		},
+		&discordgobot.CommandDefinition{
+			CommandID: "music-clear",
+			Triggers: []string{
+				"clear",
+			},
+			Description: "Clears the queue",
+			Callback:    p.runClearMusicCommand,
+		},
+		&discordgobot.CommandDefinition{
+			CommandID: "music-replay",
+			Triggers: []string{
+				"replay",
+			},
+			Description: "Reset the progress of the current song",
+			Callback:    p.runReplayMusicCommand,
+		},
+		&discordgobot.CommandDefinition{
+			CommandID: "music-seek",
+			Triggers: []string{
+				"seek",
+			},
+			Arguments: []discordgobot.CommandDefinitionArgument{
+				discordgobot.CommandDefinitionArgument{
+					Optional: false,
+					Pattern:  ".+",
+					Alias:    "timestamp",
+				},
+			},
+			Description: "Seeks to a position in the current song",
+			Callback:    p.runSeekMusicCommand,
+		},
+		&discordgobot.CommandDefinition{
+			CommandID: "music-forward",
+			Triggers: []string{
+				"forward",
+				"ff",
+			},
+			Arguments: []discordgobot.CommandDefinitionArgument{
+				discordgobot.CommandDefinitionArgument{
+					Optional: false,
+					Pattern:  ".+",
+					Alias:    "offset",
+				},
+			},
+			Description: "Fast forwards the current song by the given amount",
+			Callback:    p.runForwardMusicCommand,
+		},
+		&discordgobot.CommandDefinition{
+			CommandID: "music-rewind",
+			Triggers: []string{
+				"rewind",
+				"rw",
+			},
+			Arguments: []discordgobot.CommandDefinitionArgument{
+				discordgobot.CommandDefinitionArgument{
+					Optional: false,
+					Pattern:  ".+",
+					Alias:    "offset",
+				},
+			},
+			Description: "Rewinds the current song by the given amount",
+			Callback:    p.runRewindMusicCommand,
+		},
+		&discordgobot.CommandDefinition{
+			CommandID: "music-volume",
+			Triggers: []string{
+				"volume",
+				"vol",
+			},
+			Arguments: []discordgobot.CommandDefinitionArgument{
+				discordgobot.CommandDefinitionArgument{
+					Optional: true,
+					Pattern:  "\\d+",
+					Alias:    "volume",
+				},
+			},
+			Description: "Shows or sets the playback volume from 0 to 200",
+			Callback:    p.runVolumeMusicCommand,
+		},
+		&discordgobot.CommandDefinition{
+			CommandID: "music-pause",
+			Triggers: []string{
+				"pause",
+			},
+			Description: "Pauses the currently playing track",
+			Callback:    p.runPauseMusicCommand,
+		},
+		&discordgobot.CommandDefinition{
+			CommandID: "music-removedupes",
+			Triggers: []string{
+				"removedupes",
+			},
+			Description: "Removes duplicate songs from the queue",
+			Callback:    p.runRemoveDupesMusicCommand,
+		},
+		&discordgobot.CommandDefinition{
+			CommandID: "music-shuffle",
+			Triggers: []string{
+				"shuffle",
+			},
+			Description: "Shuffles the queue",
+			Callback:    p.runShuffleMusicCommand,
+		},
+		&discordgobot.CommandDefinition{
+			CommandID: "music-previous",
+			Triggers: []string{
+				"previous",
+				"prev",
+			},
+			Description: "Plays the previous song again",
+			Callback:    p.runPreviousMusicCommand,
+		},
+		&discordgobot.CommandDefinition{
+			CommandID: "music-history",
+			Triggers: []string{
+				"history",
+			},
+			Description: "Lists recently played songs",
+			Callback:    p.runHistoryMusicCommand,
+		},
+		&discordgobot.CommandDefinition{
+			CommandID: "music-playlistmode",
+			Triggers: []string{
+				"playlistmode",
+			},
+			Arguments: []discordgobot.CommandDefinitionArgument{
+				discordgobot.CommandDefinitionArgument{
+					Optional: true,
+					Pattern:  "ask|video|playlist",
+					Alias:    "mode",
+				},
+			},
+			Description: "Sets whether a link to a video in a playlist queues the video, the playlist, or asks",
+			Callback:    p.runPlaylistModeMusicCommand,
+		},
+		&discordgobot.CommandDefinition{
+			CommandID: "music-library-search",
+			Triggers: []string{
+				"library",
+			},
+			Arguments: []discordgobot.CommandDefinitionArgument{
+				discordgobot.CommandDefinitionArgument{
+					Optional: false,
+					Pattern:  "search",
+					Alias:    "action",
+				},
+				discordgobot.CommandDefinitionArgument{
+					Optional: false,
+					Pattern:  ".+",
+					Alias:    "query",
+				},
+			},
+			Description: "Searches the local music library",
+			Callback:    p.runLibrarySearchMusicCommand,
+		},
+		&discordgobot.CommandDefinition{
+			CommandID: "music-queue",
+			Triggers: []string{
+				"queue",
+			},
+			Description: "View the queue",
+			Callback:    p.runQueueMusicCommand,
+		},
+	}
+}
+
+func (p *MusicPlugin) runPlayMusicCommand(bot *discordgobot.Gobot, client *discordgobot.DiscordClient, payload discordgobot.CommandPayload) {
+	userID := payload.Message.UserID()
+	guildID, _ := payload.Message.ResolveGuildID()
+
+	voiceState := findVoiceChannel(client.Session, guildID, userID)
+	if voiceState == nil {
+		client.SendMessage(payload.Message.Channel(), "You must be in a voice channel to use this command.")
+		return
+	}
+
+	ytURL := payload.Arguments["url"]
+	// Library paths may name a whole directory, so queue everything they
+	// resolve to.
+	queuePlaylist := strings.HasPrefix(ytURL, libraryPrefix)
+	if link, ok := parseYouTubeLink(ytURL); ok && link.PlaylistID != "" {
+		queuePlaylist = true
+		if link.VideoID != "" && !p.wantsWholePlaylist(client, payload.Message, voiceState.GuildID) {
+			ytURL = link.VideoURL()
+			queuePlaylist = false
+		}
+	}
+
+	// The player is only looked up once the user has answered, as it may be
+	// disconnected while they think.
+	player := p.getOrStartPlayer(client, voiceState.GuildID, payload.Message.Channel())
+
+	if ytURL != "" {
+		if queuePlaylist {
+			progress := newPlaylistProgress(client.Session, payload.Message.Channel())
+			playlist, err := player.AddPlaylistToQueue(ytURL, payload.Message.UserName(), progress.report)
+			if err != nil {
+				client.SendMessage(payload.Message.Channel(), fmt.Sprintf("Unable to queue playlist: %v", err))
+				return
+			}
+
+			if len(playlist.Items) == 1 {
+				client.SendMessage(payload.Message.Channel(), fmt.Sprintf("Adding `%s` to the queue", playlist.Items[0].Title))
+			} else if playlist.ItemCount > len(playlist.Items) {
+				client.SendMessage(payload.Message.Channel(), fmt.Sprintf("Adding %v of %v songs to the queue from `%s`", len(playlist.Items), playlist.ItemCount, playlist.Title))
+			} else {
+				client.SendMessage(payload.Message.Channel(), fmt.Sprintf("Adding %v songs to the queue from `%s`", len(playlist.Items), playlist.Title))
+			}
+		} else {
+			vid, err := player.AddSongToQueue(ytURL, payload.Message.UserName())
+			if err != nil {
+				client.SendMessage(payload.Message.Channel(), fmt.Sprintf("Unable to queue song: %v", err))
+				return
+			}
+
+			client.SendMessage(payload.Message.Channel(), fmt.Sprintf("Adding `%s` to the queue", vid.Title))
+		}
+	}
+
+	if !p.checkPlayer(client, payload.Message.Channel(), voiceState.GuildID, player) {
+		return
+	}
+
+	go p.playMusicInChannel(client.Session, player, voiceState.GuildID, voiceState.ChannelID)
+}
+
+func (p *MusicPlugin) runSearchMusicCommand(bot *discordgobot.Gobot, client *discordgobot.DiscordClient, payload discordgobot.CommandPayload) {
+	userID := payload.Message.UserID()
+	guildID, err := payload.Message.ResolveGuildID()
+	if err != nil {
+		client.SendMessage(payload.Message.Channel(), "Songs can only be searched for in a server.")
+		return
+	}
+
+	if findVoiceChannel(client.Session, guildID, userID) == nil {
+		client.SendMessage(payload.Message.Channel(), "You must be in a voice channel to use this command.")
+		return
+	}
+
+	results, err := p.config.Client.Search(payload.Arguments["query"], searchResultCount)
+	if err != nil {
+		client.SendMessage(payload.Message.Channel(), fmt.Sprintf("Unable to search: %v", err))
+		return
+	}
+	if len(results) == 0 {
+		client.SendMessage(payload.Message.Channel(), "No videos found.")
+		return
+	}
+
+	var sb strings.Builder
+
+	for i, result := range results {
+		duration := "live"
+		if result.Duration > 0 {
+			duration = formatTimestamp(result.Duration)
+		}
+
+		sb.WriteString(fmt.Sprintf("%v. [%s](%s)\n`%s | %s`\n", i+1, result.Title, youtubeWatchURL(result.VideoID), result.Channel, duration))
+	}
+	sb.WriteString(fmt.Sprintf("\nPick a song by sending its number or reacting within %v.", promptTimeout))
+
+	embed := &discordgo.MessageEmbed{
+		Title:       "Search results",
+		Color:       0x070707,
+		Description: sb.String(),
+	}
+
+	if results[0].ThumbnailURL != "" {
+		embed.Thumbnail = &discordgo.MessageEmbedThumbnail{
+			URL: results[0].ThumbnailURL,
+		}
+	}
+
+	choice, ok := p.askForNumber(client.Session, payload.Message.Channel(), userID, embed, len(results))
+	if !ok {
+		client.SendMessage(payload.Message.Channel(), "No song picked, search cancelled.")
+		return
+	}
+
+	// The user may have left voice while choosing.
+	voiceState := findVoiceChannel(client.Session, guildID, userID)
+	if voiceState == nil {
+		client.SendMessage(payload.Message.Channel(), "You must be in a voice channel to use this command.")
+		return
+	}
+
+	player := p.getOrStartPlayer(client, voiceState.GuildID, payload.Message.Channel())
+
+	vid, err := player.AddSongToQueue(youtubeWatchURL(results[choice].VideoID), payload.Message.UserName())
+	if err != nil {
+		client.SendMessage(payload.Message.Channel(), fmt.Sprintf("Unable to queue song: %v", err))
+		return
+	}
+
+	client.SendMessage(payload.Message.Channel(), fmt.Sprintf("Adding `%s` to the queue", vid.Title))
+
+	if !p.checkPlayer(client, payload.Message.Channel(), voiceState.GuildID, player) {
+		return
+	}
+
+	go p.playMusicInChannel(client.Session, player, voiceState.GuildID, voiceState.ChannelID)
+}
+
+// wantsWholePlaylist decides whether a link to a video within a playlist
+// queues the playlist, asking the user unless the guild has chosen.
+func (p *MusicPlugin) wantsWholePlaylist(client *discordgobot.DiscordClient, message discordgobot.Message, guildID string) bool {
+	switch p.getPlaylistMode(guildID) {
+	case playlistModeVideo:
+		return false
+	case playlistModePlaylist:
+		return true
+	}
+
+	choice, ok := p.askWithReactions(client.Session, message.Channel(), message.UserID(),
+		fmt.Sprintf("That video is part of a playlist. React with %s to queue just the video or %s to queue the playlist from it.", reactionVideo, reactionPlaylist),
+		[]string{reactionVideo, reactionPlaylist})
+	if !ok {
+		client.SendMessage(message.Channel(), "No answer, queueing just the video.")
+		return false
+	}
+
+	return choice == 1
+}
+
+func (p *MusicPlugin) runDisconnectMusicCommand(bot *discordgobot.Gobot, client *discordgobot.DiscordClient, payload discordgobot.CommandPayload) {
+	guildID, _ := payload.Message.ResolveGuildID()
+
+	p.disconnectPlayer(guildID)
+}
+
+func (p *MusicPlugin) runNowPlayingMusicCommand(bot *discordgobot.Gobot, client *discordgobot.DiscordClient, payload discordgobot.CommandPayload) {
+	player := p.getGuildPlayer(payload.Message)
+	if player == nil {
+		client.SendMessage(payload.Message.Channel(), "Nothing is playing right now.")
+		return
+	}
+
+	np := player.ActiveSong()
+	if np == nil {
+		client.SendMessage(payload.Message.Channel(), "Nothing is playing right now.")
+		return
+	}
+
+	elapsed := player.Position()
+
+	var sb strings.Builder
+
+	if player.IsPaused() {
+		sb.WriteString(":pause_button: ")
+	} else {
+		sb.WriteString(":arrow_forward: ")
+	}
+	sb.WriteString(fmt.Sprintf("`%s` `%s / %s`", progressBar(elapsed, np.Duration, 20), formatTimestamp(elapsed), formatTimestamp(np.Duration)))
+
+	var status []string
+	if player.IsPaused() {
+		status = append(status, "Paused")
+	}
+	if player.IsLoopingSong() {
+		status = append(status, "Looping song")
+	}
+	if player.IsLoopingQueue() {
+		status = append(status, "Looping queue")
+	}
+	if len(status) > 0 {
+		sb.WriteString(fmt.Sprintf("\n\n**%s**", strings.Join(status, " | ")))
+	}
+
+	embed := &discordgo.MessageEmbed{
+		Title:       np.Title,
+		URL:         np.PageURL,
+		Color:       0x070707,
+		Description: sb.String(),
+		Author: &discordgo.MessageEmbedAuthor{
+			Name: "Now Playing",
+		},
+	}
+
+	if np.ThumbnailURL != "" {
+		embed.Thumbnail = &discordgo.MessageEmbedThumbnail{
+			URL: np.ThumbnailURL,
+		}
+	}
+
+	client.SendEmbedMessage(payload.Message.Channel(), embed)
+}
+
+func (p *MusicPlugin) runSkipMusicCommand(bot *discordgobot.Gobot, client *discordgobot.DiscordClient, payload discordgobot.CommandPayload) {
+	if player := p.getGuildPlayer(payload.Message); player != nil {
+		player.Skip()
+	}
+}
+
+func (p *MusicPlugin) runRemoveMusicCommand(bot *discordgobot.Gobot, client *discordgobot.DiscordClient, payload discordgobot.CommandPayload) {
+	player := p.getGuildPlayer(payload.Message)
+	if player == nil {
+		return
+	}
+
+	start, end, err := parseQueueRange(payload.Arguments["position"])
+	if err != nil {
+		client.SendMessage(payload.Message.Channel(), "Positions look like `3` or `3-7`.")
+		return
+	}
+
+	removed, err := player.RemoveRange(start, end)
+	if err != nil {
+		client.SendMessage(payload.Message.Channel(), fmt.Sprintf("Unable to remove: %v", err))
+		return
+	}
+
+	if len(removed) == 1 {
+		client.SendMessage(payload.Message.Channel(), fmt.Sprintf("Removed `%s` from the queue", removed[0].Title))
+	} else {
+		client.SendMessage(payload.Message.Channel(), fmt.Sprintf("Removed %v songs from the queue", len(removed)))
+	}
+}
+
+func (p *MusicPlugin) runLoopQueueMusicCommand(bot *discordgobot.Gobot, client *discordgobot.DiscordClient, payload discordgobot.CommandPayload) {
+	if player := p.getGuildPlayer(payload.Message); player != nil {
+		if player.ToggleLoopQueue() {
+			client.SendMessage(payload.Message.Channel(), "Queue looping enabled!")
+		} else {
+			client.SendMessage(payload.Message.Channel(), "Queue looping disabled")
+		}
+	}
+}
+
+func (p *MusicPlugin) runLoopMusicCommand(bot *discordgobot.Gobot, client *discordgobot.DiscordClient, payload discordgobot.CommandPayload) {
+	if player := p.getGuildPlayer(payload.Message); player != nil {
+		if player.ToggleLoopSong() {
+			client.SendMessage(payload.Message.Channel(), "Song looping enabled!")
+		} else {
+			client.SendMessage(payload.Message.Channel(), "Song looping enabled!")
+		}
+	}
+}
+
+func (p *MusicPlugin) runResumeMusicCommand(bot *discordgobot.Gobot, client *discordgobot.DiscordClient, payload discordgobot.CommandPayload) {
+	if player := p.getGuildPlayer(payload.Message); player != nil {
+		if player.Resume() {
+			client.SendMessage(payload.Message.Channel(), "Resumed!")
+			return
+		}
+
+		guildID, _ := payload.Message.ResolveGuildID()
+		userID := payload.Message.UserID()
+
+		voiceState := findVoiceChannel(client.Session, guildID, userID)
+		if voiceState == nil {
+			client.SendMessage(payload.Message.Channel(), "You must be in a voice channel to use this command.")
+			return
+		}
+
+		go p.playMusicInChannel(client.Session, player, voiceState.GuildID, voiceState.ChannelID)
+	}
+}
+
+func (p *MusicPlugin) runSkipToMusicCommand(bot *discordgobot.Gobot, client *discordgobot.DiscordClient, payload discordgobot.CommandPayload) {
+	player := p.getGuildPlayer(payload.Message)
+	if player == nil {
+		return
+	}
+
+	position, err := strconv.Atoi(strings.TrimSpace(payload.Arguments["queuePosition"]))
+	if err != nil {
+		client.SendMessage(payload.Message.Channel(), "Position must be a number from the queue.")
+		return
+	}
+
+	item, err := player.SkipTo(position)
+	if err != nil {
+		client.SendMessage(payload.Message.Channel(), fmt.Sprintf("Unable to skip: %v", err))
+		return
+	}
+
+	client.SendMessage(payload.Message.Channel(), fmt.Sprintf("Skipping to `%s`", item.Title))
+}
+
+func (p *MusicPlugin) runClearMusicCommand(bot *discordgobot.Gobot, client *discordgobot.DiscordClient, payload discordgobot.CommandPayload) {
+	if player := p.getGuildPlayer(payload.Message); player != nil {
+		player.ClearQueue()
+		client.SendMessage(payload.Message.Channel(), "Queue cleared!")
+	}
+}
+
+func (p *MusicPlugin) runReplayMusicCommand(bot *discordgobot.Gobot, client *discordgobot.DiscordClient, payload discordgobot.CommandPayload) {
+	if player := p.getGuildPlayer(payload.Message); player != nil {
+		player.Replay()
+	}
+}
+
+func (p *MusicPlugin) runSeekMusicCommand(bot *discordgobot.Gobot, client *discordgobot.DiscordClient, payload discordgobot.CommandPayload) {
+	position, err := parseTimestamp(payload.Arguments["timestamp"])
+	if err != nil {
+		client.SendMessage(payload.Message.Channel(), "Timestamps look like `1:23` or `90s`.")
+		return
+	}
+
+	if player := p.getGuildPlayer(payload.Message); player != nil {
+		if pos, ok := player.Seek(position); ok {
+			p.sendSeekPosition(client, payload, player, pos)
+		}
+	}
+}
+
+func (p *MusicPlugin) runForwardMusicCommand(bot *discordgobot.Gobot, client *discordgobot.DiscordClient, payload discordgobot.CommandPayload) {
+	offset, err := parseTimestamp(payload.Arguments["offset"])
+	if err != nil {
+		client.SendMessage(payload.Message.Channel(), "Offsets look like `30s` or `1:00`.")
+		return
+	}
+
+	if player := p.getGuildPlayer(payload.Message); player != nil {
+		if pos, ok := player.SeekBy(offset); ok {
+			p.sendSeekPosition(client, payload, player, pos)
+		}
+	}
+}
+
+func (p *MusicPlugin) runRewindMusicCommand(bot *discordgobot.Gobot, client *discordgobot.DiscordClient, payload discordgobot.CommandPayload) {
+	offset, err := parseTimestamp(payload.Arguments["offset"])
+	if err != nil {
+		client.SendMessage(payload.Message.Channel(), "Offsets look like `15s` or `0:15`.")
+		return
+	}
+
+	if player := p.getGuildPlayer(payload.Message); player != nil {
+		if pos, ok := player.SeekBy(-offset); ok {
+			p.sendSeekPosition(client, payload, player, pos)
+		}
+	}
+}
+
+func (p *MusicPlugin) runVolumeMusicCommand(bot *discordgobot.Gobot, client *discordgobot.DiscordClient, payload discordgobot.CommandPayload) {
+	guildID, err := payload.Message.ResolveGuildID()
+	if err != nil {
+		client.SendMessage(payload.Message.Channel(), "Volume can only be set in a server.")
+		return
+	}
+
+	if payload.Arguments["volume"] == "" {
+		client.SendMessage(payload.Message.Channel(), fmt.Sprintf("Volume is at %v%%", p.getVolume(guildID)))
+		return
+	}
+
+	volume, err := strconv.Atoi(payload.Arguments["volume"])
+	if err == nil {
+		err = p.setVolume(guildID, volume)
+	}
+	if err != nil {
+		client.SendMessage(payload.Message.Channel(), fmt.Sprintf("Unable to set volume: %v", err))
+		return
+	}
+
+	client.SendMessage(payload.Message.Channel(), fmt.Sprintf("Volume set to %v%%", volume))
+}
+
+func (p *MusicPlugin) runPauseMusicCommand(bot *discordgobot.Gobot, client *discordgobot.DiscordClient, payload discordgobot.CommandPayload) {
+	if player := p.getGuildPlayer(payload.Message); player != nil {
+		if player.Pause() {
+			client.SendMessage(payload.Message.Channel(), "Paused!")
+		}
+	}
+}
+
+func (p *MusicPlugin) runRemoveDupesMusicCommand(bot *discordgobot.Gobot, client *discordgobot.DiscordClient, payload discordgobot.CommandPayload) {
+	if player := p.getGuildPlayer(payload.Message); player != nil {
+		player.RemoveDuplicates()
+		client.SendMessage(payload.Message.Channel(), "Duplicates removed!")
+	}
+}
+
+func (p *MusicPlugin) runShuffleMusicCommand(bot *discordgobot.Gobot, client *discordgobot.DiscordClient, payload discordgobot.CommandPayload) {
+	if player := p.getGuildPlayer(payload.Message); player != nil {
+		player.Shuffle()
+		client.SendMessage(payload.Message.Channel(), "Songs shuffled!")
+	}
+}
+
+func (p *MusicPlugin) runQueueMusicCommand(bot *discordgobot.Gobot, client *discordgobot.DiscordClient, payload discordgobot.CommandPayload) {
+	player := p.getGuildPlayer(payload.Message)
+	if player == nil {
+		client.SendMessage(payload.Message.Channel(), "Nothing is playing right now.")
+		return
+	}
+
+	np := player.ActiveSong()
+	if np == nil {
+		client.SendMessage(payload.Message.Channel(), "Nothing is playing right now.")
+		return
+	}
+
+	queue := player.SongQueue()
+	upNext := player.UpNext()
+
+	var sb strings.Builder
+
+	if player.IsPaused() {
+		sb.WriteString("Now Playing (paused):\n")
+	} else {
+		sb.WriteString("Now Playing:\n")
+	}
+	sb.WriteString(fmt.Sprintf("`%s | %v`", np.Title, np.Duration))
+	sb.WriteString("\n\nUpNext\n")
+
+	for i, s := range upNext {
+		if i < 10 {
+			sb.WriteString(fmt.Sprintf("`%v. %s | %v`\n", i+1, s.Title, s.Duration))
+		}
+	}
+
+	var totalDuration time.Duration
+	for _, s := range queue {
+		totalDuration += s.Duration
+	}
+
+	sb.WriteString(fmt.Sprintf("\n\n**%v songs in queue | %v total length**", len(queue), totalDuration))
+
+	embed := &discordgo.MessageEmbed{
+		Title:       "Queue",
+		Color:       0x070707,
+		Description: sb.String(),
+	}
+
+	client.SendEmbedMessage(payload.Message.Channel(), embed)
+}
+
+func (p *MusicPlugin) sendSeekPosition(client *discordgobot.DiscordClient, payload discordgobot.CommandPayload, player *MusicPlayer, position time.Duration) {
+	song := player.ActiveSong()
+	if song == nil {
+		return
+	}
+
+	client.SendMessage(payload.Message.Channel(), fmt.Sprintf("Seeked to `%s / %s`", formatTimestamp(position), formatTimestamp(song.Duration)))
+}
+
+func (p *MusicPlugin) runPreviousMusicCommand(bot *discordgobot.Gobot, client *discordgobot.DiscordClient, payload discordgobot.CommandPayload) {
+	guildID, err := payload.Message.ResolveGuildID()
+	if err != nil {
+		client.SendMessage(payload.Message.Channel(), "Songs can only be played in a server.")
+		return
+	}
+
+	// The history is kept after the bot leaves voice, so a player may need
+	// to be started to go back.
+	player := p.getPlayer(guildID)
+	if player == nil {
+		if findVoiceChannel(client.Session, guildID, payload.Message.UserID()) == nil {
+			client.SendMessage(payload.Message.Channel(), "You must be in a voice channel to use this command.")
+			return
+		}
+
+		player = p.getOrStartPlayer(client, guildID, payload.Message.Channel())
+	}
+
+	item, err := player.PlayPrevious()
+	if err != nil {
+		client.SendMessage(payload.Message.Channel(), fmt.Sprintf("Unable to go back: %v", err))
+		return
+	}
+
+	client.SendMessage(payload.Message.Channel(), fmt.Sprintf("Going back to `%s`", item.Title))
+
+	if !player.IsPlaying() {
+		voiceState := findVoiceChannel(client.Session, guildID, payload.Message.UserID())
+		if voiceState == nil {
+			client.SendMessage(payload.Message.Channel(), "You must be in a voice channel to use this command.")
+			return
+		}
+
+		go p.playMusicInChannel(client.Session, player, voiceState.GuildID, voiceState.ChannelID)
+	}
+}
+
+func (p *MusicPlugin) runHistoryMusicCommand(bot *discordgobot.Gobot, client *discordgobot.DiscordClient, payload discordgobot.CommandPayload) {
+	guildID, _ := payload.Message.ResolveGuildID()
+
+	history := p.getHistory(guildID).Entries()
+	if len(history) == 0 {
+		client.SendMessage(payload.Message.Channel(), "Nothing has been played yet.")
+		return
+	}
+
+	var sb strings.Builder
+
+	for i, entry := range history {
+		if i >= 10 {
+			break
+		}
+
+		sb.WriteString(fmt.Sprintf("`%v. %s | %v`\n", i+1, entry.Item.Title, entry.Item.Duration))
+		sb.WriteString(fmt.Sprintf("Requested by %s, played at %s\n", entry.Item.RequestedBy, entry.PlayedAt.Format("15:04")))
+	}
+
+	embed := &discordgo.MessageEmbed{
+		Title:       "History",
+		Color:       0x070707,
+		Description: sb.String(),
+	}
+
+	client.SendEmbedMessage(payload.Message.Channel(), embed)
+}
+
+func (p *MusicPlugin) runPlaylistModeMusicCommand(bot *discordgobot.Gobot, client *discordgobot.DiscordClient, payload discordgobot.CommandPayload) {
+	guildID, _ := payload.Message.ResolveGuildID()
+
+	mode := playlistMode(payload.Arguments["mode"])
+	if mode == "" {
+		client.SendMessage(payload.Message.Channel(), fmt.Sprintf("Links to a video in a playlist are set to `%s`.", p.getPlaylistMode(guildID)))
+		return
+	}
+
+	p.setPlaylistMode(guildID, mode)
+
+	switch mode {
+	case playlistModeVideo:
+		client.SendMessage(payload.Message.Channel(), "Links to a video in a playlist will queue just the video.")
+	case playlistModePlaylist:
+		client.SendMessage(payload.Message.Channel(), "Links to a video in a playlist will queue the playlist from that video.")
+	default:
+		client.SendMessage(payload.Message.Channel(), "I'll ask what to queue for links to a video in a playlist.")
+	}
+}
+
+func (p *MusicPlugin) runLibrarySearchMusicCommand(bot *discordgobot.Gobot, client *discordgobot.DiscordClient, payload discordgobot.CommandPayload) {
+	if p.library == nil {
+		client.SendMessage(payload.Message.Channel(), "No music library is configured.")
+		return
+	}
+
+	tracks := p.library.Search(payload.Arguments["query"], 10)
+	if len(tracks) == 0 {
+		client.SendMessage(payload.Message.Channel(), "No tracks found.")
+		return
+	}
+
+	var sb strings.Builder
+
+	for i, track := range tracks {
+		duration := ""
+		if track.Probe != nil {
+			duration = formatTimestamp(track.Probe.Duration)
+		}
+
+		sb.WriteString(fmt.Sprintf("`%v. %s | %s`\n`%s%s`\n", i+1, track.Name(), duration, libraryPrefix, track.Path))
+	}
+
+	embed := &discordgo.MessageEmbed{
+		Title:       "Library",
+		Color:       0x070707,
+		Description: sb.String(),
+	}
+
+	client.SendEmbedMessage(payload.Message.Channel(), embed)
+}
+
+// playlistProgress keeps a single chat message up to date while a large
+// playlist is loading.
+type playlistProgress struct {
+	session   *discordgo.Session
+	channelID string
+	message   *discordgo.Message
+}
+
+func newPlaylistProgress(session *discordgo.Session, channelID string) *playlistProgress {
+	return &playlistProgress{
+		session:   session,
+		channelID: channelID,
+	}
+}
+
+func (p *playlistProgress) report(loaded int, total int) {
+	text := fmt.Sprintf("Loading playlist: loaded %v songs...", loaded)
+	if total > 0 {
+		text = fmt.Sprintf("Loading playlist: loaded %v/%v songs...", loaded, total)
+	}
+
+	if p.message == nil {
+		p.message, _ = p.session.ChannelMessageSend(p.channelID, text)
+		return
+	}
+
+	p.session.ChannelMessageEdit(p.channelID, p.message.ID, text)
+}
+
+// progressBar draws a fixed width text bar with a marker at elapsed.
+func progressBar(elapsed time.Duration, total time.Duration, width int) string {
+	marker := 0
+	if total > 0 {
+		marker = int(int64(width-1) * int64(elapsed) / int64(total))
+	}
+	if marker < 0 {
+		marker = 0
+	}
+	if marker > width-1 {
+		marker = width - 1
+	}
+
+	return strings.Repeat("▬", marker) + "🔘" + strings.Repeat("▬", width-1-marker)
+}
+
+// parseQueueRange reads a single queue position or an inclusive start-end range.
+func parseQueueRange(s string) (int, int, error) {
+	parts := strings.SplitN(s, "-", 2)
+
+	start, err := strconv.Atoi(strings.TrimSpace(parts[0]))
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if len(parts) == 1 {
+		return start, start, nil
+	}
+
+	end, err := strconv.Atoi(strings.TrimSpace(parts[1]))
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return start, end, nil
+}
+
+func findVoiceChannel(s *discordgo.Session, guildID string, userID string) *discordgo.VoiceState {
+	guild, err := s.Guild(guildID)
+	if err != nil || guild == nil {
+		return nil
+	}
+
+	for _, s := range guild.VoiceStates {
+		if s.UserID == userID {
+			return s
+		}
+	}
+
+	return nil
+}
+
+func (p *MusicPlugin) playMusicInChannel(s *discordgo.Session, player *MusicPlayer, guildID string, channelID string) {
+	if !player.IsConnected() {
+		vc, _ := s.ChannelVoiceJoin(guildID, channelID, false, true)
+		player.Join(vc)
+	}
+
+	player.Play()
+}
+
+// handlePlayerEvent reports player events to the text channel the player was
+// started from and keeps the idle timer in step with playback.
+func (p *MusicPlugin) handlePlayerEvent(client *discordgobot.DiscordClient, guildID string, channelID string, player *MusicPlayer, event PlayerEvent) {
+	switch event.Type {
+	case SongStarted:
+		p.stopIdleTimer(guildID)
+	case SongFailed:
+		client.SendMessage(channelID, fmt.Sprintf("Unable to play `%s`: %v", event.Song.Title, event.Err))
+	case QueueEmpty:
+		p.startIdleTimer(client, guildID, channelID, player)
+	case Disconnected:
+		p.stopIdleTimer(guildID)
+	}
+}
+
+func (p *MusicPlugin) getGuildPlayer(message discordgobot.Message) *MusicPlayer {
+	guildID, err := message.ResolveGuildID()
+	if err != nil {
+		return nil
+	}
+
+	return p.getPlayer(guildID)
+}
+
+func (p *MusicPlugin) getPlaylistMode(guildID string) playlistMode {
+	p.RLock()
+	defer p.RUnlock()
+
+	if mode, ok := p.playlistModes[guildID]; ok {
+		return mode
+	}
+	return playlistModeAsk
+}
+
+func (p *MusicPlugin) setPlaylistMode(guildID string, mode playlistMode) {
+	p.Lock()
+	p.playlistModes[guildID] = mode
+	p.Unlock()
+
+	p.saveData()
+}
+
+func (p *MusicPlugin) getVolume(guildID string) int {
+	p.RLock()
+	defer p.RUnlock()
+
+	if volume, ok := p.volumes[guildID]; ok {
+		return volume
+	}
+	return defaultVolume
+}
+
+// setVolume sets the volume of guildID, applying it to the guild's player if
+// it has one.
+func (p *MusicPlugin) setVolume(guildID string, volume int) error {
+	if err := checkVolume(volume); err != nil {
+		return err
+	}
+
+	p.Lock()
+	p.volumes[guildID] = volume
+	player := p.players[guildID]
+	p.Unlock()
+
+	if player != nil {
+		player.SetVolume(volume)
+	}
+
+	p.saveData()
+	return nil
+}
+
+func (p *MusicPlugin) getPlayer(guildID string) *MusicPlayer {
+	p.RLock()
+	defer p.RUnlock()
+
+	return p.players[guildID]
+}
+
+// checkPlayer reports whether player is still the player for guildID,
+// telling channelID if it is not. Resolving songs can take a while, and the
+// player may be disconnected for being idle or left alone in the meantime;
+// starting it again would keep it in voice with nothing tracking it.
+func (p *MusicPlugin) checkPlayer(client *discordgobot.DiscordClient, channelID string, guildID string, player *MusicPlayer) bool {
+	if p.getPlayer(guildID) == player {
+		return true
+	}
+
+	client.SendMessage(channelID, "Disconnected while the songs were being queued, please try again.")
+	return false
+}
+
+// getOrStartPlayer returns the player for guildID, creating one that reports
+// its events to textChannelID if the guild has none.
+func (p *MusicPlugin) getOrStartPlayer(client *discordgobot.DiscordClient, guildID string, textChannelID string) *MusicPlayer {
+	player, created := p.getOrCreatePlayer(guildID, textChannelID)
+	if created {
+		player.Subscribe(func(player *MusicPlayer, event PlayerEvent) {
+			p.handlePlayerEvent(client, guildID, textChannelID, player, event)
+		})
+	}
+	return player
+}
+
+// getOrCreatePlayer returns the player for guildID, creating one bound to
+// textChannelID if the guild has none.
+func (p *MusicPlugin) getOrCreatePlayer(guildID string, textChannelID string) (*MusicPlayer, bool) {
+	p.Lock()
+	defer p.Unlock()
+
+	player, ok := p.players[guildID]
+	if !ok {
+		player = NewMusicPlayer(p.sources, p.historyLocked(guildID))
+		if volume, ok := p.volumes[guildID]; ok {
+			player.SetVolume(volume)
+		}
+		p.players[guildID] = player
+		p.textChannels[guildID] = textChannelID
+	}
+
+	return player, !ok
+}
+
+// disconnectPlayer leaves voice in guildID and frees its player.
+func (p *MusicPlugin) disconnectPlayer(guildID string) {
+	if player := p.removePlayer(guildID); player != nil {
+		player.Shutdown()
+	}
+}
+
+func (p *MusicPlugin) removePlayer(guildID string) *MusicPlayer {
+	p.Lock()
+	defer p.Unlock()
+
+	player := p.players[guildID]
+	delete(p.players, guildID)
+	delete(p.textChannels, guildID)
+
+	return player
+}
+
+// getHistory returns the playback history of guildID.
+func (p *MusicPlugin) getHistory(guildID string) *PlayHistory {
+	p.Lock()
+	defer p.Unlock()
+
+	return p.historyLocked(guildID)
+}
+
+// historyLocked returns the playback history of guildID, creating it if
+// needed. The caller must hold the plugin lock.
+func (p *MusicPlugin) historyLocked(guildID string) *PlayHistory {
+	history, ok := p.histories[guildID]
+	if !ok {
+		history = NewPlayHistory()
+		p.histories[guildID] = history
+	}
+	return history
+}
+
+func (p *MusicPlugin) getTextChannel(guildID string) string {
+	p.RLock()
+	defer p.RUnlock()
+
+	return p.textChannels[guildID]
+}
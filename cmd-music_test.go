@@ -0,0 +1,132 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// tempDir creates a directory that is removed when the test ends.
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "music-bot-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		os.RemoveAll(dir)
+	})
+	return dir
+}
+
+func newTestPlugin(t *testing.T) *MusicPlugin {
+	return NewMusicPlugin(&MusicPluginConfig{
+		CacheDir: tempDir(t),
+		Sources:  []Source{&fakeSource{packets: 5}},
+	}).(*MusicPlugin)
+}
+
+func TestMusicPluginVolumeOutlivesPlayer(t *testing.T) {
+	p := newTestPlugin(t)
+
+	if err := p.setVolume("guild", 50); err != nil {
+		t.Fatalf("setVolume without a player: %v", err)
+	}
+
+	player, _ := p.getOrCreatePlayer("guild", "text")
+	if got := player.Volume(); got != 50 {
+		t.Errorf("new player volume = %v, want 50", got)
+	}
+
+	if err := p.setVolume("guild", 80); err != nil {
+		t.Fatalf("setVolume: %v", err)
+	}
+	if got := player.Volume(); got != 80 {
+		t.Errorf("player volume after setVolume = %v, want 80", got)
+	}
+
+	p.removePlayer("guild")
+	player, _ = p.getOrCreatePlayer("guild", "text")
+	if got := player.Volume(); got != 80 {
+		t.Errorf("volume after the player was replaced = %v, want 80", got)
+	}
+
+	if got := p.getVolume("other"); got != defaultVolume {
+		t.Errorf("volume of another guild = %v, want %v", got, defaultVolume)
+	}
+	if err := p.setVolume("guild", maxVolume+1); err == nil {
+		t.Error("setVolume accepted a volume above the maximum")
+	}
+}
+
+func TestMusicPluginHistoryOutlivesPlayer(t *testing.T) {
+	p := newTestPlugin(t)
+
+	player, _ := p.getOrCreatePlayer("guild", "text")
+	player.history.Add(&PlaylistItem{Title: "a"})
+
+	p.removePlayer("guild")
+
+	if got := len(p.getHistory("guild").Entries()); got != 1 {
+		t.Fatalf("history without a player has %v entries, want 1", got)
+	}
+
+	player, _ = p.getOrCreatePlayer("guild", "text")
+	item, err := player.PlayPrevious()
+	if err != nil {
+		t.Fatalf("PlayPrevious on a new player: %v", err)
+	}
+	if item.Title != "a" {
+		t.Errorf("PlayPrevious = %s, want a", item.Title)
+	}
+}
+
+func TestMusicPluginSettingsSurviveRestart(t *testing.T) {
+	dataFile := filepath.Join(tempDir(t), "music.json")
+	newPlugin := func() *MusicPlugin {
+		p := NewMusicPlugin(&MusicPluginConfig{
+			CacheDir: tempDir(t),
+			DataFile: dataFile,
+		}).(*MusicPlugin)
+		if err := p.loadData(); err != nil {
+			t.Fatalf("loadData: %v", err)
+		}
+		return p
+	}
+
+	p := newPlugin()
+	if got := p.getPlaylistMode("guild"); got != playlistModeAsk {
+		t.Errorf("playlist mode without a data file = %v, want %v", got, playlistModeAsk)
+	}
+
+	p.setPlaylistMode("guild", playlistModePlaylist)
+	if err := p.setVolume("guild", 30); err != nil {
+		t.Fatal(err)
+	}
+
+	p = newPlugin()
+	if got := p.getPlaylistMode("guild"); got != playlistModePlaylist {
+		t.Errorf("playlist mode after a restart = %v, want %v", got, playlistModePlaylist)
+	}
+	if got := p.getVolume("guild"); got != 30 {
+		t.Errorf("volume after a restart = %v, want 30", got)
+	}
+	if got := p.getPlaylistMode("other"); got != playlistModeAsk {
+		t.Errorf("playlist mode of another guild = %v, want %v", got, playlistModeAsk)
+	}
+}
+
+func TestMusicPluginLoadRejectsCorruptData(t *testing.T) {
+	dataFile := filepath.Join(tempDir(t), "music.json")
+	if err := ioutil.WriteFile(dataFile, []byte("{"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	p := NewMusicPlugin(&MusicPluginConfig{
+		CacheDir: tempDir(t),
+		DataFile: dataFile,
+	}).(*MusicPlugin)
+	if err := p.loadData(); err == nil {
+		t.Error("loadData accepted a corrupt file")
+	}
+}
@@ -1,6 +1,6 @@
 module github.com/lampjaw/music-bot
 
-go 1.12
+go 1.14
 
 require (
 	github.com/bwmarrin/discordgo v0.20.2
@@ -9,4 +9,5 @@ require (
 	github.com/lampjaw/discordgobot v0.4.0
 	github.com/petar/GoLLRB v0.0.0-20190514000832-33fb24c13b99 // indirect
 	github.com/rylio/ytdl v0.6.2
+	layeh.com/gopus v0.0.0-20210501142526-1ee02d434e32
 )
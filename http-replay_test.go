@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+var record = flag.Bool("record", false, "record the YouTube responses in testdata/replay from the network")
+
+// replayDir holds the recorded responses.
+var replayDir = filepath.Join("testdata", "replay")
+
+// testDownloadHost is where fakeVideos sends format downloads. The responses
+// are served from testdata/tone.webm rather than recorded.
+const testDownloadHost = "rr1---sn-test.googlevideo.com"
+
+// recordingTransport passes requests on to transport and saves every response
+// to dir, so that a replayTransport can answer the same requests later without
+// a network.
+type recordingTransport struct {
+	transport http.RoundTripper
+	dir       string
+}
+
+func (t *recordingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	key, err := recordingKey(req)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := t.transport.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+
+	dump, err := httputil.DumpResponse(resp, true)
+	if err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+
+	if err := os.MkdirAll(t.dir, 0755); err != nil {
+		return nil, err
+	}
+	if err := ioutil.WriteFile(filepath.Join(t.dir, key), dump, 0644); err != nil {
+		return nil, err
+	}
+
+	return resp, nil
+}
+
+// replayTransport answers requests with the responses a recordingTransport
+// saved to dir. Requests that were not recorded fail.
+type replayTransport struct {
+	dir string
+}
+
+func (t *replayTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	key, err := recordingKey(req)
+	if err != nil {
+		return nil, err
+	}
+
+	dump, err := ioutil.ReadFile(filepath.Join(t.dir, key))
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("no recorded response for %s %s in %s", req.Method, req.URL, key)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return http.ReadResponse(bufio.NewReader(bytes.NewReader(dump)), req)
+}
+
+var regexpRecordingName = regexp.MustCompile(`[^A-Za-z0-9.=-]+`)
+
+// recordingKey names the file a response is saved in. It covers what makes
+// two requests differ in this bot: the method, URL, range and body. The name
+// starts with the request for readability and ends with a hash of all of it.
+// The body of req is restored after reading it.
+func recordingKey(req *http.Request) (string, error) {
+	var body []byte
+	if req.Body != nil {
+		var err error
+		body, err = ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return "", err
+		}
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+
+	request := fmt.Sprintf("%s %s %s", req.Method, req.URL, req.Header.Get("Range"))
+
+	hash := sha1.New()
+	fmt.Fprintln(hash, request)
+	hash.Write(body)
+
+	name := regexpRecordingName.ReplaceAllString(strings.TrimPrefix(request, req.Method+" "+req.URL.Scheme+"://"), "_")
+	name = strings.Trim(name, "_")
+	if len(name) > 80 {
+		name = name[:80]
+	}
+
+	return fmt.Sprintf("%s_%s-%s.http", req.Method, name, hex.EncodeToString(hash.Sum(nil))[:8]), nil
+}
+
+// downloadTransport serves every request from data, honouring ranges like a
+// video server.
+type downloadTransport struct {
+	data []byte
+}
+
+func (t *downloadTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	w := httptest.NewRecorder()
+	w.Header().Set("Content-Type", "audio/webm")
+	http.ServeContent(w, req, "", time.Time{}, bytes.NewReader(t.data))
+
+	resp := w.Result()
+	resp.Request = req
+	return resp, nil
+}
+
+// hostTransport sends requests for host to one transport and the rest to
+// another.
+type hostTransport struct {
+	host      string
+	transport http.RoundTripper
+	fallback  http.RoundTripper
+}
+
+func (t *hostTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Host == t.host {
+		return t.transport.RoundTrip(req)
+	}
+	return t.fallback.RoundTrip(req)
+}
+
+// newReplayClient returns a Client that answers YouTube requests from the
+// recordings, or records them when the tests are run with -record, and
+// downloads every format as testdata/tone.webm.
+func newReplayClient(t *testing.T, videos *fakeVideos) *Client {
+	var youtube http.RoundTripper = &replayTransport{dir: replayDir}
+	if *record {
+		youtube = &recordingTransport{transport: http.DefaultTransport, dir: replayDir}
+	}
+
+	videos.downloadURL = "https://" + testDownloadHost
+
+	return &Client{
+		HTTPClient: &http.Client{
+			Transport: &hostTransport{
+				host:      testDownloadHost,
+				transport: &downloadTransport{data: readTestData(t, "tone.webm")},
+				fallback:  youtube,
+			},
+		},
+		Videos: videos,
+	}
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+)
+
+var httpAudioExtensions = map[string]bool{
+	".opus": true,
+	".webm": true,
+	".ogg":  true,
+	".mp3":  true,
+}
+
+// HTTPSource plays audio files linked directly by URL. Files are downloaded
+// to the song cache, like YouTube songs.
+type HTTPSource struct {
+	client *Client
+	cache  *SongCache
+}
+
+func NewHTTPSource(client *Client, cache *SongCache) *HTTPSource {
+	return &HTTPSource{
+		client: client,
+		cache:  cache,
+	}
+}
+
+func (s *HTTPSource) Name() string {
+	return "HTTP"
+}
+
+func (s *HTTPSource) Handles(input string) bool {
+	u, err := url.ParseRequestURI(input)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return false
+	}
+
+	return httpAudioExtensions[strings.ToLower(path.Ext(u.Path))]
+}
+
+func (s *HTTPSource) Resolve(input string) (*PlaylistInfo, error) {
+	u, err := url.ParseRequestURI(input)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.checkContentType(input); err != nil {
+		return nil, err
+	}
+
+	item := &PlaylistItem{
+		VideoID:    input,
+		Title:      path.Base(u.Path),
+		IsPlayable: true,
+		PageURL:    input,
+		Source:     s,
+	}
+
+	if probe, err := s.probe(input); err == nil {
+		item.Duration = probe.Duration
+		if probe.Title != "" {
+			item.Title = probe.Title
+		}
+	}
+
+	return &PlaylistInfo{
+		Items: []*PlaylistItem{item},
+	}, nil
+}
+
+func (s *HTTPSource) Prepare(item *PlaylistItem) error {
+	download, err := s.startDownload(item)
+	if err != nil {
+		return err
+	}
+
+	return download.Wait()
+}
+
+func (s *HTTPSource) Open(item *PlaylistItem) (AudioStream, error) {
+	download, err := s.startDownload(item)
+	if err != nil {
+		return nil, err
+	}
+
+	return openDownload(download)
+}
+
+func (s *HTTPSource) Release(item *PlaylistItem) error {
+	item.mu.Lock()
+	defer item.mu.Unlock()
+
+	s.cache.Release(item)
+	return nil
+}
+
+func (s *HTTPSource) startDownload(item *PlaylistItem) (*progressiveDownload, error) {
+	item.mu.Lock()
+	defer item.mu.Unlock()
+
+	// A plain URL cannot be refreshed, so when the server refuses it the
+	// download backs off and tries the same URL again.
+	rawurl := item.VideoID
+	return s.cache.Download(item, s.fileName(item), func(w io.Writer) error {
+		return s.client.resumableDownload(func(refresh bool) (string, error) {
+			return rawurl, nil
+		}, w)
+	})
+}
+
+// checkContentType makes sure rawurl serves audio, falling back to a GET
+// request for servers that do not support HEAD.
+func (s *HTTPSource) checkContentType(rawurl string) error {
+	resp, err := s.client.httpHead(rawurl)
+	if err == nil && resp.StatusCode == http.StatusMethodNotAllowed {
+		resp.Body.Close()
+		resp, err = s.client.httpGetAndCheckResponse(rawurl)
+	}
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status code: %v", resp.StatusCode)
+	}
+
+	contentType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	switch {
+	case strings.HasPrefix(contentType, "audio/"),
+		contentType == "video/webm",
+		contentType == "video/ogg",
+		contentType == "application/ogg",
+		contentType == "application/octet-stream",
+		contentType == "":
+		return nil
+	}
+
+	return fmt.Errorf("%s is not audio (%s)", rawurl, contentType)
+}
+
+// probe reads the duration and title of the file at rawurl from its first
+// bytes, and for Ogg files its last bytes, so the file is not downloaded
+// before it is queued.
+func (s *HTTPSource) probe(rawurl string) (*audioProbe, error) {
+	head, size, err := s.client.httpGetRange(rawurl, 0, probeHeadSize)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case bytes.HasPrefix(head, webmMagic):
+		return probeWebm(head), nil
+
+	case bytes.HasPrefix(head, oggCapturePattern):
+		probe, preSkip := probeOggHead(head)
+
+		tail := head
+		if size > int64(len(head)) {
+			start := size - probeTailSize
+			if start < 0 {
+				start = 0
+			}
+			if tail, _, err = s.client.httpGetRange(rawurl, start, size-start); err != nil {
+				return probe, nil
+			}
+		}
+
+		// Granule positions count 48kHz samples, including the pre-skip.
+		if granule := oggLastGranule(tail); granule > preSkip {
+			probe.Duration = time.Duration(granule-preSkip) * time.Second / 48000
+		}
+		return probe, nil
+	}
+
+	probe, tagEnd := probeID3(head)
+
+	var frames []byte
+	if tagEnd < int64(len(head)) {
+		frames = head[tagEnd:]
+	} else if tagEnd < size {
+		if frames, _, err = s.client.httpGetRange(rawurl, tagEnd, probeFrameSize); err != nil {
+			return probe, nil
+		}
+	}
+
+	// The duration is only exact for constant bitrate files.
+	if bitrate := mp3Bitrate(frames); bitrate > 0 && size > tagEnd {
+		probe.Duration = time.Duration(float64(size-tagEnd) * 8 / float64(bitrate) * float64(time.Second))
+	}
+	return probe, nil
+}
+
+func (s *HTTPSource) fileName(item *PlaylistItem) string {
+	u, _ := url.Parse(item.VideoID)
+	hash := sha1.Sum([]byte(item.VideoID))
+
+	return fmt.Sprintf("http-%s%s", hex.EncodeToString(hash[:]), strings.ToLower(path.Ext(u.Path)))
+}
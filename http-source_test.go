@@ -0,0 +1,320 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// requestLog records the requests a test server received.
+type requestLog struct {
+	mu       sync.Mutex
+	requests []string
+}
+
+func (l *requestLog) add(r *http.Request) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.requests = append(l.requests, strings.TrimSpace(r.Method+" "+r.Header.Get("Range")))
+}
+
+func (l *requestLog) get() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return append([]string(nil), l.requests...)
+}
+
+func readTestData(t *testing.T, name string) []byte {
+	data, err := ioutil.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// testMP3 builds an MP3 file with an ID3v2.3 title and one second of 128kbps
+// frame data. Only the first frame header is real, which is all the probe
+// reads.
+func testMP3(title string) []byte {
+	frame := append([]byte("TIT2"), 0, 0, 0, byte(len(title)+1), 0, 0, 3)
+	frame = append(frame, title...)
+
+	var b bytes.Buffer
+	b.WriteString("ID3")
+	b.Write([]byte{3, 0, 0, 0, 0, 0, byte(len(frame))})
+	b.Write(frame)
+
+	audio := make([]byte, 16000)
+	copy(audio, []byte{0xff, 0xfb, 0x90, 0x00})
+	b.Write(audio)
+
+	return b.Bytes()
+}
+
+// serveAudio returns a handler serving data with the given content type. It
+// supports HEAD and range requests.
+func serveAudio(contentType string, data []byte) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", contentType)
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+	}
+}
+
+// longOgg pads an Ogg file past the first probe range and repeats its last
+// page at the end, so the duration has to come from a second request.
+func longOgg(data []byte) []byte {
+	last := data[bytes.LastIndex(data, oggCapturePattern):]
+	long := append(append([]byte(nil), data...), make([]byte, probeHeadSize)...)
+	return append(long, last...)
+}
+
+func newTestHTTPSource(t *testing.T) *HTTPSource {
+	client := &Client{HTTPClient: http.DefaultClient}
+	return NewHTTPSource(client, NewSongCache(tempDir(t), 1<<20))
+}
+
+func TestHTTPSourceResolve(t *testing.T) {
+	tests := []struct {
+		name         string
+		path         string
+		handler      func(data []byte) http.HandlerFunc
+		data         []byte
+		wantErr      bool
+		wantTitle    string
+		wantDuration time.Duration
+		wantRequests []string
+	}{
+		{
+			name: "ogg",
+			path: "/tone.opus",
+			handler: func(data []byte) http.HandlerFunc {
+				return serveAudio("audio/ogg", data)
+			},
+			data:         readTestData(t, "tone.opus"),
+			wantTitle:    "Test Tone",
+			wantDuration: time.Second,
+			// The whole file fits in the first range, so the end is not
+			// requested separately.
+			wantRequests: []string{"HEAD", "GET bytes=0-65535"},
+		},
+		{
+			name: "long ogg",
+			path: "/tone.opus",
+			handler: func(data []byte) http.HandlerFunc {
+				return serveAudio("audio/ogg", data)
+			},
+			data:         longOgg(readTestData(t, "tone.opus")),
+			wantTitle:    "Test Tone",
+			wantDuration: time.Second,
+			wantRequests: []string{"HEAD", "GET bytes=0-65535", "GET bytes=5227-70762"},
+		},
+		{
+			name: "webm",
+			path: "/tone.webm",
+			handler: func(data []byte) http.HandlerFunc {
+				return serveAudio("video/webm", data)
+			},
+			data:         readTestData(t, "tone.webm"),
+			wantTitle:    "Test Tone",
+			wantDuration: time.Second,
+			wantRequests: []string{"HEAD", "GET bytes=0-65535"},
+		},
+		{
+			name: "mp3",
+			path: "/tone.mp3",
+			handler: func(data []byte) http.HandlerFunc {
+				return serveAudio("audio/mpeg", data)
+			},
+			data:         testMP3("Test Tone"),
+			wantTitle:    "Test Tone",
+			wantDuration: time.Second,
+			wantRequests: []string{"HEAD", "GET bytes=0-65535"},
+		},
+		{
+			name: "head not allowed",
+			path: "/tone.opus",
+			handler: func(data []byte) http.HandlerFunc {
+				return func(w http.ResponseWriter, r *http.Request) {
+					if r.Method == "HEAD" {
+						w.WriteHeader(http.StatusMethodNotAllowed)
+						return
+					}
+					serveAudio("audio/ogg", data)(w, r)
+				}
+			},
+			data:         readTestData(t, "tone.opus"),
+			wantTitle:    "Test Tone",
+			wantDuration: time.Second,
+			wantRequests: []string{"HEAD", "GET", "GET bytes=0-65535"},
+		},
+		{
+			name: "not audio",
+			path: "/tone.opus",
+			handler: func(data []byte) http.HandlerFunc {
+				return serveAudio("text/html; charset=utf-8", data)
+			},
+			data:         []byte("<html></html>"),
+			wantErr:      true,
+			wantRequests: []string{"HEAD"},
+		},
+		{
+			name: "no metadata",
+			path: "/song.mp3",
+			handler: func(data []byte) http.HandlerFunc {
+				return serveAudio("audio/mpeg", data)
+			},
+			data:         make([]byte, 100),
+			wantTitle:    "song.mp3",
+			wantRequests: []string{"HEAD", "GET bytes=0-65535"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var log requestLog
+			handler := test.handler(test.data)
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				log.add(r)
+				handler(w, r)
+			}))
+			defer server.Close()
+
+			info, err := newTestHTTPSource(t).Resolve(server.URL + test.path)
+			if got := log.get(); strings.Join(got, ", ") != strings.Join(test.wantRequests, ", ") {
+				t.Errorf("requests = %q, want %q", got, test.wantRequests)
+			}
+
+			if test.wantErr {
+				if err == nil {
+					t.Fatal("Resolve succeeded, want an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Resolve: %v", err)
+			}
+
+			item := info.Items[0]
+			if item.Title != test.wantTitle {
+				t.Errorf("Title = %q, want %q", item.Title, test.wantTitle)
+			}
+			if item.Duration != test.wantDuration {
+				t.Errorf("Duration = %v, want %v", item.Duration, test.wantDuration)
+			}
+		})
+	}
+}
+
+func TestHTTPSourceResumesInterruptedDownload(t *testing.T) {
+	setDownloadRetryDelay(t, time.Millisecond)
+
+	data := readTestData(t, "tone.webm")
+	half := len(data) / 2
+
+	var log requestLog
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		log.add(r)
+		if r.Header.Get("Range") != "" {
+			serveAudio("video/webm", data)(w, r)
+			return
+		}
+
+		// Drop the connection half way through the file.
+		conn, buf, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+
+		buf.WriteString("HTTP/1.1 200 OK\r\nContent-Type: video/webm\r\n")
+		buf.WriteString("Content-Length: " + strconv.Itoa(len(data)) + "\r\n\r\n")
+		buf.Write(data[:half])
+		buf.Flush()
+	}))
+	defer server.Close()
+
+	source := newTestHTTPSource(t)
+	item := &PlaylistItem{VideoID: server.URL + "/tone.webm", Source: source}
+
+	if err := source.Prepare(item); err != nil {
+		t.Fatalf("Prepare: %v", err)
+	}
+
+	want := []string{"GET", "GET bytes=" + strconv.Itoa(half) + "-"}
+	if got := log.get(); strings.Join(got, ", ") != strings.Join(want, ", ") {
+		t.Errorf("requests = %q, want %q", got, want)
+	}
+
+	got, err := ioutil.ReadFile(source.cache.Path(source.fileName(item)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("downloaded %v bytes that differ from the %v served", len(got), len(data))
+	}
+}
+
+func TestCheckPublicAddress(t *testing.T) {
+	tests := []struct {
+		address string
+		public  bool
+	}{
+		{address: "93.184.216.34:80", public: true},
+		{address: "[2606:2800:220:1:248:1893:25c8:1946]:443", public: true},
+		{address: "127.0.0.1:80"},
+		{address: "127.1.2.3:8080"},
+		{address: "[::1]:80"},
+		{address: "169.254.169.254:80"},
+		{address: "[fe80::1]:80"},
+		{address: "10.1.2.3:80"},
+		{address: "172.16.0.1:80"},
+		{address: "172.31.255.255:80"},
+		{address: "192.168.1.1:443"},
+		{address: "100.64.0.1:80"},
+		{address: "[fd00::1]:80"},
+		{address: "0.0.0.0:80"},
+		{address: "[::ffff:127.0.0.1]:80"},
+	}
+
+	for _, test := range tests {
+		err := checkPublicAddress("tcp", test.address, nil)
+		if test.public && err != nil {
+			t.Errorf("%s refused: %v", test.address, err)
+		}
+		if !test.public && !errors.Is(err, errPrivateAddress) {
+			t.Errorf("%s allowed, want it refused as private", test.address)
+		}
+	}
+}
+
+func TestHTTPSourceRefusesPrivateAddresses(t *testing.T) {
+	var log requestLog
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		log.add(r)
+		serveAudio("audio/ogg", readTestData(t, "tone.opus"))(w, r)
+	}))
+	defer server.Close()
+
+	client := &Client{HTTPClient: newHTTPClient(time.Second, time.Second, checkPublicAddress)}
+	source := NewHTTPSource(client, NewSongCache(tempDir(t), 1<<20))
+
+	// The test server listens on loopback, like a service on the bot's own
+	// machine would.
+	if _, err := source.Resolve(server.URL + "/tone.opus"); !errors.Is(err, errPrivateAddress) {
+		t.Errorf("err = %v, want the private address refused", err)
+	}
+	if requests := log.get(); len(requests) != 0 {
+		t.Errorf("server received %q", requests)
+	}
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const libraryPrefix = "file:"
+
+var libraryExtensions = map[string]bool{
+	".flac": true,
+	".mp3":  true,
+	".ogg":  true,
+	".opus": true,
+	".m4a":  true,
+	".wav":  true,
+}
+
+// LibraryTrack is an audio file in the local music library.
+type LibraryTrack struct {
+	// Path is relative to the library directory and uses forward slashes.
+	Path  string
+	Probe *audioProbe
+
+	// size and modTime tell whether the file has changed since its tags
+	// were read.
+	size    int64
+	modTime time.Time
+}
+
+// Name is how the track is shown in chat.
+func (t *LibraryTrack) Name() string {
+	if t.Probe == nil || t.Probe.Title == "" {
+		return strings.TrimSuffix(path.Base(t.Path), path.Ext(t.Path))
+	}
+	if t.Probe.Artist == "" {
+		return t.Probe.Title
+	}
+	return t.Probe.Artist + " - " + t.Probe.Title
+}
+
+// LibrarySource plays audio files from a local directory. Tracks are queued
+// with file:<path relative to the directory>, with or without the extension.
+// Giving a directory queues every track in it. Files added after the library
+// was indexed are found by indexing it again when a path is not found.
+type LibrarySource struct {
+	sync.RWMutex
+	dir    string
+	tracks map[string]*LibraryTrack
+	// indexMu keeps indexes from running at the same time.
+	indexMu sync.Mutex
+}
+
+// NewLibrarySource indexes dir in the background and returns immediately.
+func NewLibrarySource(dir string) *LibrarySource {
+	s := &LibrarySource{
+		dir:    dir,
+		tracks: make(map[string]*LibraryTrack),
+	}
+
+	go func() {
+		if err := s.Index(); err != nil {
+			log.Printf("Failed to index music library: %v", err)
+		}
+	}()
+
+	return s
+}
+
+func (s *LibrarySource) Name() string {
+	return "Library"
+}
+
+func (s *LibrarySource) Handles(input string) bool {
+	return strings.HasPrefix(input, libraryPrefix)
+}
+
+func (s *LibrarySource) Resolve(input string) (*PlaylistInfo, error) {
+	query := path.Clean("/" + strings.TrimPrefix(input, libraryPrefix))[1:]
+
+	tracks := s.lookup(query)
+	if len(tracks) == 0 {
+		// The file may have been added since the library was indexed.
+		if err := s.Index(); err != nil {
+			log.Printf("Failed to index music library: %v", err)
+		}
+		tracks = s.lookup(query)
+	}
+	if len(tracks) == 0 {
+		return nil, fmt.Errorf("no tracks found for %s", query)
+	}
+
+	info := &PlaylistInfo{
+		Title: query,
+	}
+
+	for _, track := range tracks {
+		info.Items = append(info.Items, s.newPlaylistItem(track))
+	}
+
+	return info, nil
+}
+
+func (s *LibrarySource) Open(item *PlaylistItem) (AudioStream, error) {
+	return openAudioFile(s.fullPath(item.VideoID))
+}
+
+// Index walks the library directory and reads the tags of every audio file.
+// Files that have not changed since the last index keep the tags read then,
+// or their lack of tags if reading them failed.
+func (s *LibrarySource) Index() error {
+	s.indexMu.Lock()
+	defer s.indexMu.Unlock()
+
+	s.RLock()
+	previous := s.tracks
+	s.RUnlock()
+
+	tracks := make(map[string]*LibraryTrack)
+
+	err := filepath.Walk(s.dir, func(fullPath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if info.IsDir() || !libraryExtensions[strings.ToLower(filepath.Ext(fullPath))] {
+			return nil
+		}
+
+		rel, err := filepath.Rel(s.dir, fullPath)
+		if err != nil {
+			return err
+		}
+
+		track := &LibraryTrack{
+			Path:    filepath.ToSlash(rel),
+			size:    info.Size(),
+			modTime: info.ModTime(),
+		}
+
+		if old, ok := previous[track.Path]; ok && old.size == track.size && old.modTime.Equal(track.modTime) {
+			track.Probe = old.Probe
+		} else if probe, err := probeAudio(fullPath); err == nil {
+			track.Probe = probe
+		} else {
+			log.Printf("Failed to read tags of %s: %v", rel, err)
+		}
+
+		tracks[track.Path] = track
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	s.Lock()
+	s.tracks = tracks
+	s.Unlock()
+
+	return nil
+}
+
+// Search returns up to limit tracks whose path or tags contain text.
+func (s *LibrarySource) Search(text string, limit int) []*LibraryTrack {
+	text = strings.ToLower(text)
+
+	s.RLock()
+	defer s.RUnlock()
+
+	var results []*LibraryTrack
+	for _, track := range s.tracks {
+		haystack := track.Path
+		if track.Probe != nil {
+			haystack += " " + track.Probe.Title + " " + track.Probe.Artist + " " + track.Probe.Album
+		}
+
+		if strings.Contains(strings.ToLower(haystack), text) {
+			results = append(results, track)
+		}
+	}
+
+	sort.Slice(results, func(i, j int) bool { return results[i].Path < results[j].Path })
+
+	if len(results) > limit {
+		results = results[:limit]
+	}
+	return results
+}
+
+// lookup finds the track at query, ignoring the extension, or every track
+// below query when it names a directory.
+func (s *LibrarySource) lookup(query string) []*LibraryTrack {
+	s.RLock()
+	defer s.RUnlock()
+
+	if track, ok := s.tracks[query]; ok {
+		return []*LibraryTrack{track}
+	}
+
+	var tracks []*LibraryTrack
+	for p, track := range s.tracks {
+		if strings.TrimSuffix(p, path.Ext(p)) == query {
+			return []*LibraryTrack{track}
+		}
+
+		if query != "" && strings.HasPrefix(p, query+"/") {
+			tracks = append(tracks, track)
+		}
+	}
+
+	sort.Slice(tracks, func(i, j int) bool { return tracks[i].Path < tracks[j].Path })
+	return tracks
+}
+
+func (s *LibrarySource) fullPath(rel string) string {
+	return filepath.Join(s.dir, filepath.FromSlash(rel))
+}
+
+func (s *LibrarySource) newPlaylistItem(track *LibraryTrack) *PlaylistItem {
+	item := &PlaylistItem{
+		VideoID:    track.Path,
+		Title:      track.Name(),
+		IsPlayable: true,
+		Source:     s,
+	}
+
+	if track.Probe != nil {
+		item.Duration = track.Probe.Duration
+	}
+
+	return item
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// fakeFFprobe points ffprobePath at a script that reports every file as
+// titled "Tagged", and returns the path of the file it logs each call to.
+func fakeFFprobe(t *testing.T) string {
+	dir := tempDir(t)
+	calls := filepath.Join(dir, "calls")
+	script := "#!/bin/sh\necho \"$@\" >> " + calls + "\necho '{\"format\":{\"duration\":\"1.0\",\"tags\":{\"TITLE\":\"Tagged\"}}}'\n"
+
+	path := filepath.Join(dir, "ffprobe")
+	if err := ioutil.WriteFile(path, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	previous := ffprobePath
+	ffprobePath = path
+	t.Cleanup(func() {
+		ffprobePath = previous
+	})
+
+	return calls
+}
+
+func TestLibrarySourceFindsNewFiles(t *testing.T) {
+	calls := fakeFFprobe(t)
+	countCalls := func() int {
+		data, err := ioutil.ReadFile(calls)
+		if os.IsNotExist(err) {
+			return 0
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		return strings.Count(string(data), "\n")
+	}
+
+	dir := tempDir(t)
+	if err := ioutil.WriteFile(filepath.Join(dir, "old.mp3"), []byte("old"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	source := &LibrarySource{dir: dir, tracks: make(map[string]*LibraryTrack)}
+	if err := source.Index(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A file added after indexing is found by indexing again, which only
+	// reads the tags of the new file.
+	if err := os.MkdirAll(filepath.Join(dir, "album"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "album", "new.opus"), []byte("new"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := source.Resolve("file:album/new")
+	if err != nil {
+		t.Fatalf("Resolve of a new file: %v", err)
+	}
+	if item := info.Items[0]; item.VideoID != "album/new.opus" || item.Title != "Tagged" {
+		t.Errorf("resolved %s titled %q, want album/new.opus titled Tagged", item.VideoID, item.Title)
+	}
+	if n := countCalls(); n != 2 {
+		t.Errorf("read tags %v times, want 2", n)
+	}
+
+	if _, err := source.Resolve("file:missing"); err == nil {
+		t.Error("Resolve of a missing file succeeded")
+	}
+	if n := countCalls(); n != 2 {
+		t.Errorf("read tags %v times after a miss, want 2", n)
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// musicPluginData is what the plugin keeps across restarts.
+type musicPluginData struct {
+	PlaylistModes map[string]playlistMode `json:"playlistModes"`
+	Volumes       map[string]int          `json:"volumes"`
+}
+
+// Save writes each guild's settings to the data file, if one is configured.
+// The file is replaced in one step so that a crash never leaves half of it.
+func (p *MusicPlugin) Save() error {
+	if p.config.DataFile == "" {
+		return nil
+	}
+
+	p.saveMu.Lock()
+	defer p.saveMu.Unlock()
+
+	p.RLock()
+	data, err := json.MarshalIndent(&musicPluginData{
+		PlaylistModes: p.playlistModes,
+		Volumes:       p.volumes,
+	}, "", "  ")
+	p.RUnlock()
+	if err != nil {
+		return err
+	}
+
+	file, err := ioutil.TempFile(filepath.Dir(p.config.DataFile), filepath.Base(p.config.DataFile)+".tmp")
+	if err != nil {
+		return err
+	}
+
+	_, err = file.Write(data)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(file.Name(), p.config.DataFile)
+	}
+	if err != nil {
+		os.Remove(file.Name())
+	}
+	return err
+}
+
+// saveData saves the settings after one has changed, logging any failure.
+func (p *MusicPlugin) saveData() {
+	if err := p.Save(); err != nil {
+		log.Printf("Failed to save music settings: %v", err)
+	}
+}
+
+// loadData reads the settings saved by Save. A missing file is not an error.
+func (p *MusicPlugin) loadData() error {
+	if p.config.DataFile == "" {
+		return nil
+	}
+
+	raw, err := ioutil.ReadFile(p.config.DataFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var data musicPluginData
+	if err := json.Unmarshal(raw, &data); err != nil {
+		return err
+	}
+
+	p.Lock()
+	defer p.Unlock()
+
+	for guildID, mode := range data.PlaylistModes {
+		p.playlistModes[guildID] = mode
+	}
+	for guildID, volume := range data.Volumes {
+		if checkVolume(volume) == nil {
+			p.volumes[guildID] = volume
+		}
+	}
+	return nil
+}
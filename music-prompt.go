@@ -0,0 +1,131 @@
+package main
+
+import (
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/lampjaw/discordgobot"
+)
+
+const promptTimeout = 30 * time.Second
+
+// numberReactions are the keycap emoji for picking 1 to 10.
+var numberReactions = []string{
+	"1\ufe0f\u20e3", "2\ufe0f\u20e3", "3\ufe0f\u20e3", "4\ufe0f\u20e3", "5\ufe0f\u20e3",
+	"6\ufe0f\u20e3", "7\ufe0f\u20e3", "8\ufe0f\u20e3", "9\ufe0f\u20e3", "\U0001f51f",
+}
+
+// chatPrompt is a question posted in chat, answered by the user it was asked
+// of reacting with one of the offered emoji or, if numbered, by sending the
+// number of a choice.
+type chatPrompt struct {
+	channelID string
+	userID    string
+	choices   []string
+	numbered  bool
+	answer    chan int
+}
+
+// askWithReactions posts text, adds a reaction for each choice and waits for
+// userID to pick one. It returns the index of the choice, or false if no
+// answer came in time.
+func (p *MusicPlugin) askWithReactions(session *discordgo.Session, channelID string, userID string, text string, choices []string) (int, bool) {
+	return p.ask(session, channelID, userID, &discordgo.MessageSend{Content: text}, choices, false)
+}
+
+// askForNumber posts embed with a numbered reaction for each of count choices
+// and waits for userID to pick one, by reaction or by sending its number. It
+// returns the 0-based index of the choice, or false if no answer came in time.
+func (p *MusicPlugin) askForNumber(session *discordgo.Session, channelID string, userID string, embed *discordgo.MessageEmbed, count int) (int, bool) {
+	if count > len(numberReactions) {
+		count = len(numberReactions)
+	}
+
+	return p.ask(session, channelID, userID, &discordgo.MessageSend{Embed: embed}, numberReactions[:count], true)
+}
+
+func (p *MusicPlugin) ask(session *discordgo.Session, channelID string, userID string, data *discordgo.MessageSend, choices []string, numbered bool) (int, bool) {
+	message, err := session.ChannelMessageSendComplex(channelID, data)
+	if err != nil {
+		log.Printf("Failed to send prompt: %v", err)
+		return 0, false
+	}
+
+	prompt := &chatPrompt{
+		channelID: channelID,
+		userID:    userID,
+		choices:   choices,
+		numbered:  numbered,
+		answer:    make(chan int, 1),
+	}
+
+	p.Lock()
+	p.prompts[message.ID] = prompt
+	p.Unlock()
+
+	defer func() {
+		p.Lock()
+		delete(p.prompts, message.ID)
+		p.Unlock()
+	}()
+
+	for _, emoji := range choices {
+		if err := session.MessageReactionAdd(channelID, message.ID, emoji); err != nil {
+			log.Printf("Failed to add reaction: %v", err)
+		}
+	}
+
+	select {
+	case choice := <-prompt.answer:
+		return choice, true
+	case <-time.After(promptTimeout):
+		return 0, false
+	}
+}
+
+func (prompt *chatPrompt) pick(choice int) {
+	select {
+	case prompt.answer <- choice:
+	default:
+	}
+}
+
+func (p *MusicPlugin) onMessageReactionAdd(s *discordgo.Session, r *discordgo.MessageReactionAdd) {
+	p.RLock()
+	prompt := p.prompts[r.MessageID]
+	p.RUnlock()
+
+	if prompt == nil || r.UserID != prompt.userID {
+		return
+	}
+
+	for i, emoji := range prompt.choices {
+		if r.Emoji.Name == emoji {
+			prompt.pick(i)
+			return
+		}
+	}
+}
+
+// Message answers numbered prompts with the number a user sends.
+func (p *MusicPlugin) Message(bot *discordgobot.Gobot, client *discordgobot.DiscordClient, message discordgobot.Message) error {
+	choice, err := strconv.Atoi(strings.TrimSpace(message.RawMessage()))
+	if err != nil {
+		return nil
+	}
+
+	p.RLock()
+	defer p.RUnlock()
+
+	for _, prompt := range p.prompts {
+		if prompt.numbered && prompt.channelID == message.Channel() && prompt.userID == message.UserID() &&
+			choice >= 1 && choice <= len(prompt.choices) {
+			prompt.pick(choice - 1)
+		}
+	}
+
+	return nil
+}
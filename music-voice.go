@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/lampjaw/discordgobot"
+)
+
+// Load restores the saved guild settings, hooks voice state tracking into
+// every shard so the bot can leave channels it has been left alone in, and
+// watches reactions for prompts.
+func (p *MusicPlugin) Load(client *discordgobot.DiscordClient) error {
+	// The bot ignores errors from Load, so they are logged here.
+	if err := p.loadData(); err != nil {
+		log.Printf("Failed to load music settings: %v", err)
+	}
+
+	for _, session := range client.Sessions {
+		session.AddHandler(func(s *discordgo.Session, v *discordgo.VoiceStateUpdate) {
+			p.onVoiceStateUpdate(client, s, v)
+		})
+		session.AddHandler(p.onMessageReactionAdd)
+	}
+
+	return nil
+}
+
+func (p *MusicPlugin) onVoiceStateUpdate(client *discordgobot.DiscordClient, s *discordgo.Session, v *discordgo.VoiceStateUpdate) {
+	player := p.getPlayer(v.GuildID)
+	if player == nil {
+		return
+	}
+
+	// The bot was kicked from voice or the connection was closed elsewhere.
+	if s.State.User != nil && v.UserID == s.State.User.ID && v.ChannelID == "" {
+		p.disconnectPlayer(v.GuildID)
+		return
+	}
+
+	channelID := player.ChannelID()
+	if channelID == "" || hasListeners(s, v.GuildID, channelID) {
+		return
+	}
+
+	if textChannelID := p.getTextChannel(v.GuildID); textChannelID != "" {
+		client.SendMessage(textChannelID, "Everyone left the voice channel, disconnecting.")
+	}
+	p.disconnectPlayer(v.GuildID)
+}
+
+// hasListeners reports whether any user other than a bot is in channelID.
+func hasListeners(s *discordgo.Session, guildID string, channelID string) bool {
+	guild, err := s.State.Guild(guildID)
+	if err != nil {
+		return true
+	}
+
+	for _, vs := range guild.VoiceStates {
+		if vs.ChannelID != channelID {
+			continue
+		}
+
+		if s.State.User != nil && vs.UserID == s.State.User.ID {
+			continue
+		}
+
+		member, err := s.State.Member(guildID, vs.UserID)
+		if err != nil || member.User == nil || !member.User.Bot {
+			return true
+		}
+	}
+
+	return false
+}
+
+// startIdleTimer disconnects player from guildID once it has been idle for the
+// configured timeout.
+func (p *MusicPlugin) startIdleTimer(client *discordgobot.DiscordClient, guildID string, channelID string, player *MusicPlayer) {
+	p.Lock()
+	defer p.Unlock()
+
+	if timer, ok := p.idleTimers[guildID]; ok {
+		timer.Stop()
+	}
+
+	p.idleTimers[guildID] = time.AfterFunc(p.config.IdleTimeout, func() {
+		if p.getPlayer(guildID) != player || player.IsPlaying() {
+			return
+		}
+
+		client.SendMessage(channelID, fmt.Sprintf("Nothing has played for %v, disconnecting.", p.config.IdleTimeout))
+		p.disconnectPlayer(guildID)
+	})
+}
+
+func (p *MusicPlugin) stopIdleTimer(guildID string) {
+	p.Lock()
+	defer p.Unlock()
+
+	if timer, ok := p.idleTimers[guildID]; ok {
+		timer.Stop()
+		delete(p.idleTimers, guildID)
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+// PlayerEventType identifies what happened in a PlayerEvent.
+type PlayerEventType int
+
+const (
+	// SongStarted is emitted when audio for a song starts being sent.
+	SongStarted PlayerEventType = iota
+	// SongFinished is emitted when a song plays through to the end.
+	SongFinished
+	// SongSkipped is emitted when a song is stopped before its end.
+	SongSkipped
+	// SongFailed is emitted when a song could not be downloaded or loaded.
+	SongFailed
+	// QueueEmpty is emitted when the playback loop runs out of songs.
+	QueueEmpty
+	// Disconnected is emitted when the player leaves the voice channel.
+	Disconnected
+)
+
+func (t PlayerEventType) String() string {
+	switch t {
+	case SongStarted:
+		return "SongStarted"
+	case SongFinished:
+		return "SongFinished"
+	case SongSkipped:
+		return "SongSkipped"
+	case SongFailed:
+		return "SongFailed"
+	case QueueEmpty:
+		return "QueueEmpty"
+	case Disconnected:
+		return "Disconnected"
+	}
+	return "Unknown"
+}
+
+// PlayerEvent describes a change in a MusicPlayer's playback. Song is nil for
+// QueueEmpty and Disconnected, and Err is only set for SongFailed.
+type PlayerEvent struct {
+	Type PlayerEventType
+	Song *PlaylistItem
+	Err  error
+}
+
+// PlayerEventHandler receives events from a MusicPlayer. Handlers are called
+// on a goroutine of their own, one event at a time and in the order the events
+// happened, so a slow handler delays later events but never playback.
+type PlayerEventHandler func(*MusicPlayer, PlayerEvent)
+
+// Subscribe registers handler for every event emitted by the player. The
+// returned function removes the handler again.
+func (p *MusicPlayer) Subscribe(handler PlayerEventHandler) func() {
+	p.eventMu.Lock()
+	defer p.eventMu.Unlock()
+
+	p.nextHandlerID++
+	id := p.nextHandlerID
+	p.handlers[id] = handler
+
+	return func() {
+		p.eventMu.Lock()
+		defer p.eventMu.Unlock()
+
+		delete(p.handlers, id)
+	}
+}
+
+// emit queues event for the handlers without waiting for them.
+func (p *MusicPlayer) emit(event PlayerEvent) {
+	p.eventMu.Lock()
+	defer p.eventMu.Unlock()
+
+	p.events = append(p.events, event)
+	if !p.dispatching {
+		p.dispatching = true
+		go p.dispatchEvents()
+	}
+}
+
+// dispatchEvents calls the handlers for queued events until none are left.
+func (p *MusicPlayer) dispatchEvents() {
+	for {
+		p.eventMu.Lock()
+		if len(p.events) == 0 {
+			p.dispatching = false
+			p.eventMu.Unlock()
+			return
+		}
+
+		event := p.events[0]
+		p.events = p.events[1:]
+
+		handlers := make([]PlayerEventHandler, 0, len(p.handlers))
+		for _, handler := range p.handlers {
+			handlers = append(handlers, handler)
+		}
+		p.eventMu.Unlock()
+
+		for _, handler := range handlers {
+			handler(p, event)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// maxHistory is how many played songs each guild remembers.
+const maxHistory = 50
+
+// HistoryEntry is a song that has been played and when it started.
+type HistoryEntry struct {
+	Item     *PlaylistItem
+	PlayedAt time.Time
+
+	id int
+	// previousID is the entry that going back from this one leads to, or 0
+	// if there is none.
+	previousID int
+}
+
+// PlayHistory is the list of songs a guild has played. It belongs to the
+// guild rather than to a player, so it is kept when the bot leaves voice.
+type PlayHistory struct {
+	mu      sync.Mutex
+	entries []*HistoryEntry
+	nextID  int
+}
+
+func NewPlayHistory() *PlayHistory {
+	return &PlayHistory{}
+}
+
+// Add records item as played. Repeats of a looping song are recorded once.
+// Going back from a song that was itself replayed from the history continues
+// from the song before the original, rather than returning to the song that
+// was playing when it was replayed.
+func (h *PlayHistory) Add(item *PlaylistItem) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	n := len(h.entries)
+	if n > 0 && h.entries[n-1].Item == item {
+		h.entries[n-1].PlayedAt = time.Now()
+		return
+	}
+
+	h.nextID++
+	entry := &HistoryEntry{
+		Item:     item,
+		PlayedAt: time.Now(),
+		id:       h.nextID,
+	}
+
+	if item.replayOf != 0 {
+		if original := h.find(item.replayOf); original != nil {
+			entry.previousID = original.previousID
+		}
+	} else if n > 0 {
+		entry.previousID = h.entries[n-1].id
+	}
+
+	h.entries = append(h.entries, entry)
+	if len(h.entries) > maxHistory {
+		h.entries = h.entries[len(h.entries)-maxHistory:]
+	}
+}
+
+// Entries returns a copy of the played songs, newest first.
+func (h *PlayHistory) Entries() []*HistoryEntry {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	entries := make([]*HistoryEntry, len(h.entries))
+	for i, entry := range h.entries {
+		copied := *entry
+		entries[len(h.entries)-1-i] = &copied
+	}
+	return entries
+}
+
+// Previous returns the entry to go back to from current, the song playing
+// now, or the newest entry if current is nil or not in the history yet. It
+// returns nil if there is nothing to go back to.
+func (h *PlayHistory) Previous(current *PlaylistItem) *HistoryEntry {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if len(h.entries) == 0 {
+		return nil
+	}
+
+	if current != nil {
+		for i := len(h.entries) - 1; i >= 0; i-- {
+			if h.entries[i].Item == current {
+				return h.find(h.entries[i].previousID)
+			}
+		}
+	}
+
+	return h.entries[len(h.entries)-1]
+}
+
+// find returns the entry with id, if it is still in the history. The caller
+// must hold mu.
+func (h *PlayHistory) find(id int) *HistoryEntry {
+	if id == 0 {
+		return nil
+	}
+
+	for _, entry := range h.entries {
+		if entry.id == id {
+			return entry
+		}
+	}
+	return nil
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestPlayHistoryPreviousGoesFurtherBack(t *testing.T) {
+	h := NewPlayHistory()
+
+	songs := make(map[string]*PlaylistItem)
+	for _, title := range []string{"a", "b", "c"} {
+		songs[title] = &PlaylistItem{Title: title}
+		h.Add(songs[title])
+	}
+
+	// A looping song is only recorded once.
+	h.Add(songs["c"])
+
+	current := songs["c"]
+	for _, want := range []string{"b", "a"} {
+		previous := h.Previous(current)
+		if previous == nil {
+			t.Fatalf("no previous song before %s, want %s", current.Title, want)
+		}
+		if previous.Item.Title != want {
+			t.Fatalf("previous of %s = %s, want %s", current.Title, previous.Item.Title, want)
+		}
+
+		current = previous.Item.clone()
+		current.replayOf = previous.id
+		h.Add(current)
+	}
+
+	if previous := h.Previous(current); previous != nil {
+		t.Errorf("previous of the first song = %s, want none", previous.Item.Title)
+	}
+
+	var titles []string
+	for _, entry := range h.Entries() {
+		titles = append(titles, entry.Item.Title)
+	}
+	if got, want := len(titles), 5; got != want {
+		t.Fatalf("history = %v, want %v entries", titles, want)
+	}
+	if titles[0] != "a" || titles[1] != "b" || titles[2] != "c" {
+		t.Errorf("history = %v, want the replays newest first", titles)
+	}
+}
+
+func TestPlayHistoryPreviousWithoutActiveSong(t *testing.T) {
+	h := NewPlayHistory()
+	if previous := h.Previous(nil); previous != nil {
+		t.Fatalf("previous of an empty history = %s, want none", previous.Item.Title)
+	}
+
+	h.Add(&PlaylistItem{Title: "a"})
+	h.Add(&PlaylistItem{Title: "b"})
+
+	if previous := h.Previous(nil); previous == nil || previous.Item.Title != "b" {
+		t.Errorf("previous with nothing playing = %v, want the last song played", previous)
+	}
+}
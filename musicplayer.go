@@ -1,219 +1,810 @@
-package main
-
-import (
-	"log"
-	"math/rand"
-	"time"
-
-	"github.com/bwmarrin/discordgo"
-	"github.com/ebml-go/webm"
-	"github.com/rylio/ytdl"
-)
-
-type MusicPlayer struct {
-	IsPlaying       bool
-	ActiveSong      *PlaylistItem
-	SongQueue       []*PlaylistItem
-	loopQueue       bool
-	loopSong        bool
-	skip            chan bool
-	replay          chan bool
-	voiceConnection *discordgo.VoiceConnection
-}
-
-func NewMusicPlayer() *MusicPlayer {
-	return &MusicPlayer{
-		IsPlaying:       false,
-		SongQueue:       make([]*PlaylistItem, 0),
-		loopQueue:       false,
-		loopSong:        false,
-		skip:            make(chan bool),
-		replay:          make(chan bool),
-		voiceConnection: nil,
-	}
-}
-
-func (p *MusicPlayer) Join(vc *discordgo.VoiceConnection) {
-	p.voiceConnection = vc
-}
-
-func (p *MusicPlayer) AddPlaylistToQueue(url string) (*PlaylistInfo, error) {
-	playlist, err := getPlaylistInfoFromURL(url)
-	if err != nil {
-		log.Printf("Failed to get playlist info: %v", err)
-		return nil, err
-	}
-
-	if playlist == nil {
-		return nil, nil
-	}
-
-	p.SongQueue = append(p.SongQueue, playlist.Items...)
-
-	return playlist, nil
-}
-
-func (p *MusicPlayer) AddSongToQueue(url string) (*PlaylistItem, error) {
-	video, err := getVideoFromURL(url)
-	if err != nil {
-		log.Printf("Failed to get video info: %v", err)
-		return nil, err
-	}
-
-	if video == nil {
-		return nil, nil
-	}
-
-	item := &PlaylistItem{
-		VideoID:      video.ID,
-		Title:        video.Title,
-		Duration:     video.Duration,
-		IsPlayable:   true,
-		ThumbnailURL: video.GetThumbnailURL(ytdl.ThumbnailQualityDefault).String(),
-		VideoInfo:    video,
-	}
-
-	p.SongQueue = append(p.SongQueue, item)
-
-	return item, nil
-}
-
-func (p *MusicPlayer) Play() {
-	if p.IsPlaying {
-		return
-	}
-
-	p.IsPlaying = true
-
-	for len(p.SongQueue) > 0 && p.IsPlaying {
-		p.playCurrentSong()
-	}
-
-	p.IsPlaying = false
-}
-
-func (p *MusicPlayer) Shutdown() {
-	p.ClearQueue()
-	p.Skip()
-	p.voiceConnection.Disconnect()
-}
-
-func (p *MusicPlayer) Skip() {
-	p.skip <- true
-}
-
-func (p *MusicPlayer) Replay() {
-	p.replay <- true
-}
-
-func (p *MusicPlayer) Shuffle() {
-	rand.Seed(time.Now().UnixNano())
-	rand.Shuffle(len(p.SongQueue), func(i, j int) { p.SongQueue[i], p.SongQueue[j] = p.SongQueue[j], p.SongQueue[i] })
-	if p.ActiveSong != p.SongQueue[0] {
-		go PrepareSong(p.SongQueue[0])
-	}
-}
-
-func (p *MusicPlayer) ClearQueue() {
-	p.SongQueue = p.SongQueue[:1]
-}
-
-func (p *MusicPlayer) RemoveDuplicates() {
-	keys := make(map[string]bool)
-	list := make([]*PlaylistItem, 0)
-	for _, entry := range p.SongQueue {
-		if _, value := keys[entry.VideoID]; !value {
-			keys[entry.VideoID] = true
-			list = append(list, entry)
-		}
-	}
-	p.SongQueue = list
-}
-
-func (p *MusicPlayer) RemoveSongFromQueue(item *PlaylistItem) {
-	if len(p.SongQueue) == 0 {
-		return
-	}
-
-	sIdx := p.findSongIndex(item.VideoID)
-	p.SongQueue = append(p.SongQueue[:sIdx], p.SongQueue[sIdx+1:]...)
-
-	RemoveSong(item)
-}
-
-func (p *MusicPlayer) playCurrentSong() {
-	p.ActiveSong = p.SongQueue[0]
-	defer p.postSongHandling(p.ActiveSong)
-
-	err := PrepareSong(p.ActiveSong)
-	if err != nil {
-		log.Printf("Failed to prepare song: %v", err)
-		return
-	}
-
-	if len(p.SongQueue) > 1 {
-		go PrepareSong(p.SongQueue[1])
-	}
-
-	file, err := GetSongFile(p.ActiveSong)
-	if err != nil {
-		log.Printf("Failed to get song file: %v", err)
-		return
-	}
-	defer file.Close()
-
-	reader, err := LoadSong(file)
-	if err != nil {
-		log.Printf("Failed to load song: %v", err)
-		return
-	}
-
-	p.voiceConnection.Speaking(true)
-	defer p.voiceConnection.Speaking(false)
-
-	p.sendSongData(reader)
-}
-
-func (p *MusicPlayer) postSongHandling(item *PlaylistItem) {
-	p.ActiveSong = nil
-
-	if p.loopQueue {
-		sIdx := p.findSongIndex(item.VideoID)
-		p.SongQueue = append(p.SongQueue[:sIdx], p.SongQueue[sIdx+1:]...)
-		p.SongQueue = append(p.SongQueue, item)
-		return
-	}
-
-	if !p.loopSong {
-		p.RemoveSongFromQueue(item)
-	}
-}
-
-func (p *MusicPlayer) sendSongData(reader *webm.Reader) {
-	reader.Seek(0)
-
-	for {
-		select {
-		case packet := <-reader.Chan:
-			if packet.Timecode == webm.BadTC {
-				return
-			}
-
-			p.voiceConnection.OpusSend <- packet.Data
-		case <-p.skip:
-			p.loopSong = false
-			return
-		case <-p.replay:
-			reader.Seek(0)
-		}
-	}
-}
-
-func (p *MusicPlayer) findSongIndex(videoID string) int {
-	for i := range p.SongQueue {
-		if p.SongQueue[i].VideoID == videoID {
-			return i
-		}
-	}
-	return -1
-}
+package main
+
+import (
+	"fmt"
+	"log"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// MusicPlayer owns the queue and playback state for a single guild. All state
+// is guarded by mu so it can be driven from command callbacks and the playback
+// loop at the same time.
+type MusicPlayer struct {
+	mu              sync.RWMutex
+	isPlaying       bool
+	isPaused        bool
+	activeSong      *PlaylistItem
+	position        time.Duration
+	seekTarget      time.Duration
+	songQueue       []*PlaylistItem
+	nextEntryID     int
+	history         *PlayHistory
+	loopQueue       bool
+	loopSong        bool
+	volume          int
+	skip            chan bool
+	replay          chan bool
+	pause           chan bool
+	resume          chan bool
+	seek            chan bool
+	voiceConnection *discordgo.VoiceConnection
+	sources         *SourceRegistry
+
+	eventMu       sync.Mutex
+	handlers      map[int]PlayerEventHandler
+	nextHandlerID int
+	events        []PlayerEvent
+	dispatching   bool
+}
+
+// NewMusicPlayer creates a player that resolves songs with sources and
+// records what it plays in history. A nil history starts a new one.
+func NewMusicPlayer(sources *SourceRegistry, history *PlayHistory) *MusicPlayer {
+	if history == nil {
+		history = NewPlayHistory()
+	}
+
+	return &MusicPlayer{
+		isPlaying:       false,
+		isPaused:        false,
+		songQueue:       make([]*PlaylistItem, 0),
+		history:         history,
+		loopQueue:       false,
+		loopSong:        false,
+		volume:          defaultVolume,
+		skip:            make(chan bool, 1),
+		replay:          make(chan bool, 1),
+		pause:           make(chan bool, 1),
+		resume:          make(chan bool, 1),
+		seek:            make(chan bool, 1),
+		voiceConnection: nil,
+		sources:         sources,
+		handlers:        make(map[int]PlayerEventHandler),
+	}
+}
+
+func (p *MusicPlayer) Join(vc *discordgo.VoiceConnection) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.voiceConnection = vc
+}
+
+func (p *MusicPlayer) IsConnected() bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	return p.voiceConnection != nil
+}
+
+// ChannelID returns the voice channel the player is connected to.
+func (p *MusicPlayer) ChannelID() string {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	if p.voiceConnection == nil {
+		return ""
+	}
+
+	p.voiceConnection.RLock()
+	defer p.voiceConnection.RUnlock()
+
+	return p.voiceConnection.ChannelID
+}
+
+func (p *MusicPlayer) IsPlaying() bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	return p.isPlaying
+}
+
+func (p *MusicPlayer) IsPaused() bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	return p.isPaused
+}
+
+func (p *MusicPlayer) ActiveSong() *PlaylistItem {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	return p.activeSong
+}
+
+// Position returns how far into the active song playback is.
+func (p *MusicPlayer) Position() time.Duration {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	return p.position
+}
+
+// SongQueue returns a snapshot of the queue that is safe to iterate while
+// playback continues.
+func (p *MusicPlayer) SongQueue() []*PlaylistItem {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	queue := make([]*PlaylistItem, len(p.songQueue))
+	copy(queue, p.songQueue)
+	return queue
+}
+
+func (p *MusicPlayer) IsLoopingQueue() bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	return p.loopQueue
+}
+
+func (p *MusicPlayer) IsLoopingSong() bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	return p.loopSong
+}
+
+func (p *MusicPlayer) Volume() int {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	return p.volume
+}
+
+// SetVolume sets the playback volume as a percentage of the original level.
+func (p *MusicPlayer) SetVolume(volume int) error {
+	if err := checkVolume(volume); err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.volume = volume
+	return nil
+}
+
+func (p *MusicPlayer) ToggleLoopQueue() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.loopQueue = !p.loopQueue
+	return p.loopQueue
+}
+
+func (p *MusicPlayer) ToggleLoopSong() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.loopSong = !p.loopSong
+	return p.loopSong
+}
+
+// AddPlaylistToQueue queues every song that input resolves to. progress, if
+// not nil, is told how loading a large playlist is getting on.
+func (p *MusicPlayer) AddPlaylistToQueue(input string, requestedBy string, progress ResolveProgress) (*PlaylistInfo, error) {
+	playlist, err := p.sources.ResolveWithProgress(input, progress)
+	if err != nil {
+		log.Printf("Failed to get playlist info: %v", err)
+		return nil, err
+	}
+
+	for _, item := range playlist.Items {
+		item.RequestedBy = requestedBy
+	}
+
+	p.enqueue(playlist.Items...)
+
+	return playlist, nil
+}
+
+// AddSongToQueue queues the first song that input resolves to.
+func (p *MusicPlayer) AddSongToQueue(input string, requestedBy string) (*PlaylistItem, error) {
+	info, err := p.sources.Resolve(input)
+	if err != nil {
+		log.Printf("Failed to get video info: %v", err)
+		return nil, err
+	}
+
+	if len(info.Items) == 0 {
+		return nil, fmt.Errorf("nothing found for %s", input)
+	}
+
+	item := info.Items[0]
+	item.RequestedBy = requestedBy
+
+	p.enqueue(item)
+
+	return item, nil
+}
+
+func (p *MusicPlayer) Play() {
+	p.mu.Lock()
+	if p.isPlaying {
+		p.mu.Unlock()
+		return
+	}
+	p.isPlaying = true
+	p.mu.Unlock()
+
+	// Drop requests that arrived while nothing was playing.
+	select {
+	case <-p.skip:
+	default:
+	}
+
+	for {
+		item, vc, drained := p.nextSong()
+		if item == nil {
+			if drained {
+				p.emit(PlayerEvent{Type: QueueEmpty})
+			}
+			return
+		}
+
+		p.playSong(item, vc)
+	}
+}
+
+func (p *MusicPlayer) Shutdown() {
+	p.mu.Lock()
+	p.isPlaying = false
+	p.isPaused = false
+	removed := p.songQueue
+	p.songQueue = nil
+	vc := p.voiceConnection
+	p.voiceConnection = nil
+	p.mu.Unlock()
+
+	p.Skip()
+
+	for _, item := range removed {
+		p.releaseSong(item)
+	}
+
+	if vc != nil {
+		vc.Disconnect()
+	}
+
+	p.emit(PlayerEvent{Type: Disconnected})
+}
+
+// Skip stops the active song. Repeated calls before the playback loop picks
+// the request up are collapsed into one.
+func (p *MusicPlayer) Skip() {
+	notify(p.skip)
+}
+
+// Replay restarts the active song.
+func (p *MusicPlayer) Replay() {
+	notify(p.replay)
+}
+
+// Seek moves playback of the active song to position, clamped to the song's
+// duration. It returns the position that will be played from, or false if
+// nothing is playing.
+func (p *MusicPlayer) Seek(position time.Duration) (time.Duration, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.seekLocked(position)
+}
+
+// SeekBy moves playback of the active song by offset relative to the current
+// position. Negative offsets rewind.
+func (p *MusicPlayer) SeekBy(offset time.Duration) (time.Duration, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.seekLocked(p.position + offset)
+}
+
+func (p *MusicPlayer) seekLocked(position time.Duration) (time.Duration, bool) {
+	if p.activeSong == nil {
+		return 0, false
+	}
+
+	if position < 0 {
+		position = 0
+	}
+	if d := p.activeSong.Duration; d > 0 && position > d {
+		position = d
+	}
+
+	p.seekTarget = position
+	p.position = position
+	notify(p.seek)
+	return position, true
+}
+
+// Pause stops sending audio while keeping the position in the active song.
+// It returns false if nothing is playing or playback is already paused.
+func (p *MusicPlayer) Pause() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if !p.isPlaying || p.isPaused {
+		return false
+	}
+
+	p.isPaused = true
+	notify(p.pause)
+	return true
+}
+
+// Resume continues a paused song from where it stopped. It returns false if
+// playback was not paused.
+func (p *MusicPlayer) Resume() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if !p.isPaused {
+		return false
+	}
+
+	p.isPaused = false
+	notify(p.resume)
+	return true
+}
+
+func (p *MusicPlayer) Shuffle() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	queue := p.songQueue
+	if len(queue) > 0 && queue[0] == p.activeSong {
+		queue = queue[1:]
+	}
+
+	rand.Seed(time.Now().UnixNano())
+	rand.Shuffle(len(queue), func(i, j int) { queue[i], queue[j] = queue[j], queue[i] })
+
+	if len(queue) > 0 {
+		go prepareSong(queue[0])
+	}
+}
+
+// ClearQueue removes every queued song except the one currently playing.
+func (p *MusicPlayer) ClearQueue() {
+	p.mu.Lock()
+	var removed []*PlaylistItem
+	if len(p.songQueue) > 0 && p.songQueue[0] == p.activeSong {
+		removed = append(removed, p.songQueue[1:]...)
+		p.songQueue = p.songQueue[:1]
+	} else {
+		removed = p.songQueue
+		p.songQueue = nil
+	}
+	p.mu.Unlock()
+
+	for _, item := range removed {
+		p.releaseSong(item)
+	}
+}
+
+func (p *MusicPlayer) RemoveDuplicates() {
+	p.mu.Lock()
+	keys := make(map[string]bool)
+	list := make([]*PlaylistItem, 0)
+	var removed []*PlaylistItem
+	for _, entry := range p.songQueue {
+		if _, value := keys[entry.VideoID]; !value {
+			keys[entry.VideoID] = true
+			list = append(list, entry)
+		} else {
+			removed = append(removed, entry)
+		}
+	}
+	p.songQueue = list
+	p.mu.Unlock()
+
+	for _, item := range removed {
+		p.releaseSong(item)
+	}
+}
+
+func (p *MusicPlayer) RemoveSongFromQueue(item *PlaylistItem) {
+	p.mu.Lock()
+	removed := p.removeSong(item)
+	p.mu.Unlock()
+
+	if removed {
+		p.releaseSong(item)
+	}
+}
+
+// History returns the most recently played songs, newest first.
+func (p *MusicPlayer) History() []*HistoryEntry {
+	return p.history.Entries()
+}
+
+// PlayPrevious queues the song that played before the active one at the front
+// of the queue and skips to it. Calling it again while that song plays goes
+// further back.
+func (p *MusicPlayer) PlayPrevious() (*PlaylistItem, error) {
+	p.mu.Lock()
+
+	previous := p.history.Previous(p.activeSong)
+	if previous == nil {
+		p.mu.Unlock()
+		return nil, fmt.Errorf("no previous song")
+	}
+
+	p.nextEntryID++
+	item := previous.Item.clone()
+	item.EntryID = p.nextEntryID
+	item.replayOf = previous.id
+
+	insertAt := 0
+	if len(p.songQueue) > 0 && p.songQueue[0] == p.activeSong {
+		insertAt = 1
+	}
+	p.songQueue = append(p.songQueue[:insertAt], append([]*PlaylistItem{item}, p.songQueue[insertAt:]...)...)
+
+	playing := p.activeSong != nil
+	p.mu.Unlock()
+
+	if playing {
+		p.Skip()
+	}
+
+	return item, nil
+}
+
+// UpNext returns a snapshot of the queue without the active song. Positions
+// used by RemoveRange and SkipTo are 1-based indexes into this list.
+func (p *MusicPlayer) UpNext() []*PlaylistItem {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	upNext := p.upNext()
+	queue := make([]*PlaylistItem, len(upNext))
+	copy(queue, upNext)
+	return queue
+}
+
+// RemoveRange removes the songs between the start and end positions of the up
+// next list, inclusive.
+func (p *MusicPlayer) RemoveRange(start int, end int) ([]*PlaylistItem, error) {
+	p.mu.Lock()
+
+	upNext := p.upNext()
+	if start < 1 || end < start || end > len(upNext) {
+		p.mu.Unlock()
+		return nil, fmt.Errorf("positions must be between 1 and %v", len(upNext))
+	}
+
+	removed := make([]*PlaylistItem, end-start+1)
+	copy(removed, upNext[start-1:end])
+
+	for _, item := range removed {
+		p.removeSong(item)
+	}
+	p.mu.Unlock()
+
+	for _, item := range removed {
+		p.releaseSong(item)
+	}
+
+	return removed, nil
+}
+
+// SkipTo drops every song before position in the up next list and skips the
+// active song so that the song at position plays next. When the queue is
+// looping the dropped songs are moved to the back instead.
+func (p *MusicPlayer) SkipTo(position int) (*PlaylistItem, error) {
+	p.mu.Lock()
+
+	upNext := p.upNext()
+	if position < 1 || position > len(upNext) {
+		p.mu.Unlock()
+		return nil, fmt.Errorf("position must be between 1 and %v", len(upNext))
+	}
+
+	target := upNext[position-1]
+	skipped := make([]*PlaylistItem, position-1)
+	copy(skipped, upNext[:position-1])
+
+	for _, item := range skipped {
+		p.removeSong(item)
+	}
+
+	if p.loopQueue {
+		p.songQueue = append(p.songQueue, skipped...)
+		skipped = nil
+	}
+	p.mu.Unlock()
+
+	for _, item := range skipped {
+		p.releaseSong(item)
+	}
+
+	p.Skip()
+
+	return target, nil
+}
+
+// nextSong marks the head of the queue as the active song. It returns nil once
+// the queue is empty or playback has been stopped, clearing isPlaying so a
+// later Play call can start the loop again. drained reports whether playback
+// ended because the queue ran out.
+func (p *MusicPlayer) nextSong() (item *PlaylistItem, vc *discordgo.VoiceConnection, drained bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if !p.isPlaying || len(p.songQueue) == 0 || p.voiceConnection == nil {
+		drained = p.isPlaying && len(p.songQueue) == 0
+		p.isPlaying = false
+		p.activeSong = nil
+		return nil, nil, drained
+	}
+
+	p.activeSong = p.songQueue[0]
+	p.position = 0
+
+	// A skip or seek requested at the very end of the previous song must not
+	// carry over.
+	select {
+	case <-p.skip:
+	default:
+	}
+	select {
+	case <-p.seek:
+	default:
+	}
+
+	return p.activeSong, p.voiceConnection, false
+}
+
+func (p *MusicPlayer) playSong(item *PlaylistItem, vc *discordgo.VoiceConnection) {
+	defer p.postSongHandling(item)
+
+	stream, err := item.Source.Open(item)
+	if err != nil {
+		log.Printf("Failed to open song: %v", err)
+		p.emit(PlayerEvent{Type: SongFailed, Song: item, Err: err})
+		return
+	}
+	defer stream.Close()
+
+	p.mu.RLock()
+	if len(p.songQueue) > 1 {
+		go prepareSong(p.songQueue[1])
+	}
+	p.mu.RUnlock()
+
+	vc.Speaking(true)
+	defer vc.Speaking(false)
+
+	if item.StartTime > 0 {
+		stream.Seek(item.StartTime)
+		p.setPosition(item.StartTime)
+	}
+
+	p.history.Add(item)
+	p.emit(PlayerEvent{Type: SongStarted, Song: item})
+
+	if !p.sendSongData(stream, vc) {
+		p.emit(PlayerEvent{Type: SongSkipped, Song: item})
+		return
+	}
+
+	if err := stream.Err(); err != nil {
+		log.Printf("Failed to play song: %v", err)
+		p.emit(PlayerEvent{Type: SongFailed, Song: item, Err: err})
+		return
+	}
+
+	p.emit(PlayerEvent{Type: SongFinished, Song: item})
+}
+
+func (p *MusicPlayer) postSongHandling(item *PlaylistItem) {
+	p.mu.Lock()
+	p.activeSong = nil
+
+	if p.loopQueue {
+		if p.removeSong(item) {
+			p.songQueue = append(p.songQueue, item)
+		}
+		p.mu.Unlock()
+		return
+	}
+
+	removed := false
+	if !p.loopSong {
+		removed = p.removeSong(item)
+	}
+	p.mu.Unlock()
+
+	if removed {
+		p.releaseSong(item)
+	}
+}
+
+// sendSongData streams the song to the voice connection. It returns true if
+// the song played to the end and false if it was skipped.
+func (p *MusicPlayer) sendSongData(stream AudioStream, vc *discordgo.VoiceConnection) bool {
+	// gain is only created while the volume differs from the default, so
+	// frames are passed through untouched otherwise. If it cannot be created
+	// the song plays at its own volume rather than trying again every frame.
+	var gain *gainProcessor
+	var gainFailed bool
+	var err error
+
+	for {
+		if p.IsPaused() {
+			if !p.waitForResume(stream, vc) {
+				return false
+			}
+			continue
+		}
+
+		select {
+		case packet, ok := <-stream.Packets():
+			if !ok {
+				return true
+			}
+
+			p.setPosition(packet.Timecode)
+
+			frame := packet.Data
+			if volume := p.Volume(); volume != defaultVolume {
+				if gain == nil && !gainFailed {
+					gain, err = newGainProcessor()
+					if err != nil {
+						log.Printf("Failed to create gain processor, playing without volume control: %v", err)
+						gainFailed = true
+					}
+				}
+
+				if gain != nil {
+					if processed, err := gain.Process(frame, volume); err == nil {
+						frame = processed
+					}
+				}
+			} else {
+				gain = nil
+			}
+
+			select {
+			case vc.OpusSend <- frame:
+			case <-p.skip:
+				p.stopLoopingSong()
+				return false
+			}
+		case <-p.skip:
+			p.stopLoopingSong()
+			return false
+		case <-p.replay:
+			p.setPosition(0)
+			stream.Seek(0)
+			gain = nil
+		case <-p.seek:
+			stream.Seek(p.takeSeekTarget())
+			gain = nil
+		case <-p.pause:
+		}
+	}
+}
+
+// waitForResume blocks without reading from stream until playback is resumed.
+// It returns false if the song was skipped while paused.
+func (p *MusicPlayer) waitForResume(stream AudioStream, vc *discordgo.VoiceConnection) bool {
+	vc.Speaking(false)
+	defer vc.Speaking(true)
+
+	for p.IsPaused() {
+		select {
+		case <-p.resume:
+		case <-p.skip:
+			p.stopLoopingSong()
+			return false
+		case <-p.replay:
+			p.setPosition(0)
+			stream.Seek(0)
+		case <-p.seek:
+			stream.Seek(p.takeSeekTarget())
+		}
+	}
+
+	return true
+}
+
+func (p *MusicPlayer) setPosition(position time.Duration) {
+	if position < 0 {
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.position = position
+}
+
+func (p *MusicPlayer) takeSeekTarget() time.Duration {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	return p.seekTarget
+}
+
+func (p *MusicPlayer) stopLoopingSong() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.loopSong = false
+}
+
+// enqueue gives each item its own entry ID and appends it to the queue.
+func (p *MusicPlayer) enqueue(items ...*PlaylistItem) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, item := range items {
+		p.nextEntryID++
+		item.EntryID = p.nextEntryID
+		p.songQueue = append(p.songQueue, item)
+	}
+}
+
+// upNext returns the queue without the active song. The caller must hold mu.
+func (p *MusicPlayer) upNext() []*PlaylistItem {
+	if len(p.songQueue) > 0 && p.songQueue[0] == p.activeSong {
+		return p.songQueue[1:]
+	}
+	return p.songQueue
+}
+
+// removeSong drops item from the queue. The caller must hold mu.
+func (p *MusicPlayer) removeSong(item *PlaylistItem) bool {
+	sIdx := p.findEntryIndex(item.EntryID)
+	if sIdx < 0 {
+		return false
+	}
+
+	p.songQueue = append(p.songQueue[:sIdx], p.songQueue[sIdx+1:]...)
+	return true
+}
+
+// releaseSong lets the item's source free what it holds for an item that has
+// left the queue, such as its reference to a cached file.
+func (p *MusicPlayer) releaseSong(item *PlaylistItem) {
+	if releaser, ok := item.Source.(SongReleaser); ok {
+		if err := releaser.Release(item); err != nil {
+			log.Printf("Failed to release song: %v", err)
+		}
+	}
+}
+
+// prepareSong fetches item ahead of time if its source supports it.
+func prepareSong(item *PlaylistItem) {
+	if preparer, ok := item.Source.(SongPreparer); ok {
+		if err := preparer.Prepare(item); err != nil {
+			log.Printf("Failed to prepare song: %v", err)
+		}
+	}
+}
+
+func (p *MusicPlayer) findEntryIndex(entryID int) int {
+	for i := range p.songQueue {
+		if p.songQueue[i].EntryID == entryID {
+			return i
+		}
+	}
+	return -1
+}
+
+// notify performs a non-blocking send on a wakeup channel. The channels are
+// buffered so a request made while the playback loop is busy is not lost.
+func notify(c chan bool) {
+	select {
+	case c <- true:
+	default:
+	}
+}
@@ -0,0 +1,498 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/rylio/ytdl"
+)
+
+// fakeSource resolves any input to a song of silent frames. If err is set,
+// streams end with it after their frames instead of playing to the end.
+type fakeSource struct {
+	packets int
+	err     error
+}
+
+func (s *fakeSource) Name() string {
+	return "fake"
+}
+
+func (s *fakeSource) Handles(input string) bool {
+	return true
+}
+
+func (s *fakeSource) Resolve(input string) (*PlaylistInfo, error) {
+	return &PlaylistInfo{
+		Items: []*PlaylistItem{{
+			VideoID:    input,
+			Title:      input,
+			Duration:   time.Duration(s.packets) * opusFrameDuration,
+			IsPlayable: true,
+			Source:     s,
+		}},
+	}, nil
+}
+
+func (s *fakeSource) Open(item *PlaylistItem) (AudioStream, error) {
+	return newFakeStream(s.packets, s.err), nil
+}
+
+// fakeStream sends count 20ms frames as fast as they are read.
+type fakeStream struct {
+	packets   chan OpusPacket
+	seek      chan time.Duration
+	done      chan bool
+	closeOnce sync.Once
+	err       error
+}
+
+func newFakeStream(count int, err error) *fakeStream {
+	s := &fakeStream{
+		packets: make(chan OpusPacket),
+		seek:    make(chan time.Duration, 1),
+		done:    make(chan bool),
+		err:     err,
+	}
+
+	go s.run(count)
+
+	return s
+}
+
+func (s *fakeStream) Packets() <-chan OpusPacket {
+	return s.packets
+}
+
+func (s *fakeStream) Seek(position time.Duration) {
+	select {
+	case <-s.seek:
+	default:
+	}
+	s.seek <- position
+}
+
+func (s *fakeStream) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.done)
+	})
+	return nil
+}
+
+func (s *fakeStream) Err() error {
+	return s.err
+}
+
+func (s *fakeStream) run(count int) {
+	defer close(s.packets)
+
+	for i := 0; i < count; i++ {
+		select {
+		case s.packets <- OpusPacket{Data: []byte{0xf8, 0xff, 0xfe}, Timecode: time.Duration(i) * opusFrameDuration}:
+		case position := <-s.seek:
+			i = int(position/opusFrameDuration) - 1
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// newStubVoiceConnection returns a voice connection that discards the frames
+// sent to it. It has no websocket, so Speaking fails without side effects.
+func newStubVoiceConnection() *discordgo.VoiceConnection {
+	vc := &discordgo.VoiceConnection{
+		OpusSend: make(chan []byte),
+	}
+
+	go func() {
+		for range vc.OpusSend {
+		}
+	}()
+
+	return vc
+}
+
+func newTestPlayer(t *testing.T, source Source, songs int) *MusicPlayer {
+	player := NewMusicPlayer(NewSourceRegistry(source), nil)
+	player.Join(newStubVoiceConnection())
+
+	for i := 0; i < songs; i++ {
+		if _, err := player.AddSongToQueue(fmt.Sprintf("song %v", i), "tester"); err != nil {
+			t.Fatalf("AddSongToQueue: %v", err)
+		}
+	}
+
+	return player
+}
+
+// TestMusicPlayerConcurrentControl drives every queue and playback control at
+// once while songs play. It is meant to be run with -race.
+func TestMusicPlayerConcurrentControl(t *testing.T) {
+	player := newTestPlayer(t, &fakeSource{packets: 50}, 20)
+
+	var stopped sync.WaitGroup
+	stop := make(chan bool)
+	stopped.Add(1)
+	go func() {
+		defer stopped.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+
+			player.Play()
+			time.Sleep(time.Millisecond)
+		}
+	}()
+
+	controls := []func(){
+		player.Shuffle,
+		player.ClearQueue,
+		player.RemoveDuplicates,
+		player.Skip,
+		player.Replay,
+		func() { player.RemoveRange(1, 2) },
+		func() { player.SkipTo(2) },
+		func() { player.Pause() },
+		func() { player.Resume() },
+		func() { player.Seek(10 * opusFrameDuration) },
+		func() { player.SeekBy(-5 * opusFrameDuration) },
+		func() { player.AddSongToQueue("more", "tester") },
+		func() {
+			player.SongQueue()
+			player.UpNext()
+			player.ActiveSong()
+			player.Position()
+			player.IsPaused()
+		},
+	}
+
+	var wg sync.WaitGroup
+	for _, control := range controls {
+		wg.Add(1)
+		go func(control func()) {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				control()
+				runtime.Gosched()
+			}
+		}(control)
+	}
+	wg.Wait()
+
+	close(stop)
+	player.Resume()
+	player.ClearQueue()
+	player.Skip()
+
+	done := make(chan bool)
+	go func() {
+		stopped.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("playback did not stop after the queue was cleared")
+	}
+
+	if player.IsPlaying() {
+		t.Error("player still playing after the queue was cleared")
+	}
+}
+
+// eventRecorder records the events a player emits.
+type eventRecorder struct {
+	mu     sync.Mutex
+	events []PlayerEvent
+	queue  chan bool
+}
+
+func subscribeEvents(player *MusicPlayer) *eventRecorder {
+	c := &eventRecorder{queue: make(chan bool, 100)}
+	player.Subscribe(func(player *MusicPlayer, event PlayerEvent) {
+		c.mu.Lock()
+		c.events = append(c.events, event)
+		c.mu.Unlock()
+
+		if event.Type == QueueEmpty {
+			c.queue <- true
+		}
+	})
+	return c
+}
+
+// waitForQueueEmpty returns the events up to the end of the queue.
+func (c *eventRecorder) waitForQueueEmpty(t *testing.T) []PlayerEvent {
+	select {
+	case <-c.queue:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no QueueEmpty event")
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return append([]PlayerEvent{}, c.events...)
+}
+
+func eventTypes(events []PlayerEvent) []PlayerEventType {
+	types := make([]PlayerEventType, len(events))
+	for i, event := range events {
+		types[i] = event.Type
+	}
+	return types
+}
+
+func TestMusicPlayerReportsStreamErrors(t *testing.T) {
+	streamErr := errors.New("connection reset")
+	player := newTestPlayer(t, &fakeSource{packets: 5, err: streamErr}, 1)
+	events := subscribeEvents(player)
+
+	player.Play()
+
+	got := events.waitForQueueEmpty(t)
+	want := []PlayerEventType{SongStarted, SongFailed, QueueEmpty}
+	if fmt.Sprint(eventTypes(got)) != fmt.Sprint(want) {
+		t.Fatalf("events = %v, want %v", eventTypes(got), want)
+	}
+	if got[1].Err != streamErr {
+		t.Errorf("SongFailed error = %v, want %v", got[1].Err, streamErr)
+	}
+}
+
+func TestMusicPlayerEventsDoNotBlockPlayback(t *testing.T) {
+	player := newTestPlayer(t, &fakeSource{packets: 5}, 2)
+
+	release := make(chan bool)
+	player.Subscribe(func(player *MusicPlayer, event PlayerEvent) {
+		<-release
+	})
+	events := subscribeEvents(player)
+
+	played := make(chan bool)
+	go func() {
+		player.Play()
+		close(played)
+	}()
+
+	select {
+	case <-played:
+	case <-time.After(5 * time.Second):
+		t.Fatal("playback waited for a blocked event handler")
+	}
+
+	close(release)
+
+	got := eventTypes(events.waitForQueueEmpty(t))
+	want := []PlayerEventType{SongStarted, SongFinished, SongStarted, SongFinished, QueueEmpty}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("events = %v, want %v", got, want)
+	}
+}
+
+func newYouTubeTestPlayer(t *testing.T) *MusicPlayer {
+	client := newReplayClient(t, &fakeVideos{videos: map[string]*ytdl.VideoInfo{
+		"dQw4w9WgXcQ": testVideo("dQw4w9WgXcQ", "Never Gonna Give You Up"),
+	}})
+	youtube := NewYouTubeSource(client, NewSongCache(tempDir(t), 1<<20), 0)
+
+	player := NewMusicPlayer(NewSourceRegistry(youtube, NewYouTubeSearchSource(youtube, client)), nil)
+	player.Join(newStubVoiceConnection())
+	return player
+}
+
+func TestMusicPlayerAddSongToQueueFromYouTube(t *testing.T) {
+	player := newYouTubeTestPlayer(t)
+	events := subscribeEvents(player)
+
+	item, err := player.AddSongToQueue("https://youtu.be/dQw4w9WgXcQ?t=30", "tester")
+	if err != nil {
+		t.Fatalf("AddSongToQueue with a link: %v", err)
+	}
+	if item.Title != "Never Gonna Give You Up" || item.StartTime != 30*time.Second || item.RequestedBy != "tester" {
+		t.Errorf("queued %q from %v requested by %q", item.Title, item.StartTime, item.RequestedBy)
+	}
+
+	item, err = player.AddSongToQueue("never gonna give you up", "tester")
+	if err != nil {
+		t.Fatalf("AddSongToQueue with a search: %v", err)
+	}
+	if item.VideoID != "dQw4w9WgXcQ" || item.Duration != 213*time.Second {
+		t.Errorf("search queued %s (%v), want dQw4w9WgXcQ (3m33s)", item.VideoID, item.Duration)
+	}
+
+	// Both songs download and play through to the end.
+	player.Play()
+	got := eventTypes(events.waitForQueueEmpty(t))
+	want := []PlayerEventType{SongStarted, SongFinished, SongStarted, SongFinished, QueueEmpty}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("events = %v, want %v", got, want)
+	}
+}
+
+func TestMusicPlayerAddPlaylistToQueueFromYouTube(t *testing.T) {
+	player := newYouTubeTestPlayer(t)
+
+	var progress [][2]int
+	playlist, err := player.AddPlaylistToQueue("https://www.youtube.com/playlist?list=PLreplaytest", "tester", func(loaded, total int) {
+		progress = append(progress, [2]int{loaded, total})
+	})
+	if err != nil {
+		t.Fatalf("AddPlaylistToQueue: %v", err)
+	}
+
+	if playlist.Title != "Replay Mix" || playlist.ItemCount != 3 {
+		t.Errorf("playlist = %q with %v items, want Replay Mix with 3", playlist.Title, playlist.ItemCount)
+	}
+
+	// The last song comes from the second page of the playlist.
+	var ids []string
+	for _, item := range player.SongQueue() {
+		ids = append(ids, item.VideoID)
+		if item.RequestedBy != "tester" || item.Source == nil {
+			t.Errorf("%s was queued by %q from %v", item.VideoID, item.RequestedBy, item.Source)
+		}
+	}
+	if want := []string{"dQw4w9WgXcQ", "kJQP7kiw5Fk", "9bZkp7q19f0"}; !equalStrings(ids, want) {
+		t.Errorf("queue = %q, want %q", ids, want)
+	}
+
+	if fmt.Sprint(progress) != "[[2 3]]" {
+		t.Errorf("progress = %v, want one report of 2 of 3 before the second page", progress)
+	}
+}
+
+// newPlayingTestPlayer returns a player with five songs queued, the first of
+// which is marked as playing without running the playback loop.
+func newPlayingTestPlayer(t *testing.T) *MusicPlayer {
+	player := newTestPlayer(t, &fakeSource{}, 5)
+	player.isPlaying = true
+	player.activeSong = player.songQueue[0]
+	return player
+}
+
+func queueTitles(items []*PlaylistItem) []string {
+	titles := make([]string, len(items))
+	for i, item := range items {
+		titles[i] = item.Title
+	}
+	return titles
+}
+
+func TestMusicPlayerRemoveRange(t *testing.T) {
+	tests := []struct {
+		start, end int
+		removed    []string
+		wantErr    bool
+	}{
+		{start: 1, end: 1, removed: []string{"song 1"}},
+		{start: 2, end: 4, removed: []string{"song 2", "song 3", "song 4"}},
+		{start: 1, end: 4, removed: []string{"song 1", "song 2", "song 3", "song 4"}},
+		// The active song is not part of the up next list.
+		{start: 0, end: 1, wantErr: true},
+		{start: 3, end: 2, wantErr: true},
+		{start: 4, end: 5, wantErr: true},
+		{start: -1, end: -1, wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(fmt.Sprintf("%v-%v", test.start, test.end), func(t *testing.T) {
+			player := newPlayingTestPlayer(t)
+
+			removed, err := player.RemoveRange(test.start, test.end)
+			if test.wantErr {
+				if err == nil {
+					t.Errorf("RemoveRange removed %q, want an error", queueTitles(removed))
+				}
+				if len(player.SongQueue()) != 5 {
+					t.Errorf("queue = %q after a failed RemoveRange", queueTitles(player.SongQueue()))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("RemoveRange: %v", err)
+			}
+
+			if got := queueTitles(removed); !equalStrings(got, test.removed) {
+				t.Errorf("removed %q, want %q", got, test.removed)
+			}
+			if queue := player.SongQueue(); queue[0] != player.ActiveSong() || len(queue) != 5-len(test.removed) {
+				t.Errorf("queue = %q, want the active song and the rest", queueTitles(queue))
+			}
+		})
+	}
+}
+
+func TestMusicPlayerSkipTo(t *testing.T) {
+	tests := []struct {
+		position  int
+		loopQueue bool
+		want      []string
+		wantErr   bool
+	}{
+		{position: 1, want: []string{"song 0", "song 1", "song 2", "song 3", "song 4"}},
+		{position: 3, want: []string{"song 0", "song 3", "song 4"}},
+		{position: 4, want: []string{"song 0", "song 4"}},
+		{position: 3, loopQueue: true, want: []string{"song 0", "song 3", "song 4", "song 1", "song 2"}},
+		{position: 0, wantErr: true},
+		{position: 5, wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(fmt.Sprintf("%v loop %v", test.position, test.loopQueue), func(t *testing.T) {
+			player := newPlayingTestPlayer(t)
+			if test.loopQueue {
+				player.ToggleLoopQueue()
+			}
+
+			target, err := player.SkipTo(test.position)
+			if test.wantErr {
+				if err == nil {
+					t.Errorf("SkipTo returned %s, want an error", target.Title)
+				}
+				if len(player.skip) != 0 {
+					t.Error("a failed SkipTo skipped the active song")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("SkipTo: %v", err)
+			}
+
+			if target.Title != test.want[1] {
+				t.Errorf("target = %s, want %s", target.Title, test.want[1])
+			}
+			if got := queueTitles(player.SongQueue()); !equalStrings(got, test.want) {
+				t.Errorf("queue = %q, want %q", got, test.want)
+			}
+			if len(player.skip) != 1 {
+				t.Error("SkipTo did not skip the active song")
+			}
+		})
+	}
+}
+
+func TestMusicPlayerLateSkipDoesNotCarryOver(t *testing.T) {
+	player := newPlayingTestPlayer(t)
+
+	// The skip arrives after the active song has ended by itself.
+	player.Skip()
+	player.songQueue = player.songQueue[1:]
+
+	item, _, _ := player.nextSong()
+	if item == nil || item.Title != "song 1" {
+		t.Fatalf("nextSong = %v, want song 1", item)
+	}
+	if len(player.skip) != 0 {
+		t.Error("the skip meant for the previous song is still pending")
+	}
+}
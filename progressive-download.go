@@ -0,0 +1,212 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"os"
+	"sync"
+)
+
+// partialSuffix marks a file that is still being downloaded.
+const partialSuffix = ".part"
+
+var errReaderClosed = errors.New("reader closed")
+
+// progressiveDownload tracks a file that is still being written by a
+// download, so that it can be played before the download has finished.
+type progressiveDownload struct {
+	fileName string
+	partName string
+
+	mu   sync.Mutex
+	cond *sync.Cond
+	file *os.File
+	size int64
+	done bool
+	err  error
+}
+
+// newProgressiveDownload starts a download to fileName. Data is written to a
+// partial file that only gets renamed to fileName once it is complete, but
+// becomes visible to readers of the download straight away.
+func newProgressiveDownload(fileName string) (*progressiveDownload, error) {
+	partName := fileName + partialSuffix
+
+	file, err := os.Create(partName)
+	if err != nil {
+		return nil, err
+	}
+
+	d := &progressiveDownload{
+		fileName: fileName,
+		partName: partName,
+		file:     file,
+	}
+	d.cond = sync.NewCond(&d.mu)
+
+	return d, nil
+}
+
+// completedDownload wraps a file that has already been downloaded.
+func completedDownload(fileName string) (*progressiveDownload, error) {
+	info, err := os.Stat(fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	d := &progressiveDownload{
+		fileName: fileName,
+		size:     info.Size(),
+		done:     true,
+	}
+	d.cond = sync.NewCond(&d.mu)
+
+	return d, nil
+}
+
+func (d *progressiveDownload) Write(p []byte) (int, error) {
+	n, err := d.file.Write(p)
+
+	d.mu.Lock()
+	d.size += int64(n)
+	d.mu.Unlock()
+	d.cond.Broadcast()
+
+	return n, err
+}
+
+// finish marks the download as complete, or as failed if err is not nil. A
+// complete download is moved to its final name and a failed one is removed.
+func (d *progressiveDownload) finish(err error) {
+	closeErr := d.file.Close()
+	if err == nil {
+		err = closeErr
+	}
+
+	// The rename happens under the lock so that Open never looks for the
+	// file under the wrong name.
+	d.mu.Lock()
+	if err == nil {
+		err = os.Rename(d.partName, d.fileName)
+	}
+	if err != nil {
+		os.Remove(d.partName)
+	}
+	d.done = true
+	d.err = err
+	d.mu.Unlock()
+	d.cond.Broadcast()
+}
+
+// Wait blocks until the download has finished and returns its error.
+func (d *progressiveDownload) Wait() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for !d.done {
+		d.cond.Wait()
+	}
+	return d.err
+}
+
+// Failed reports whether the download has finished with an error.
+func (d *progressiveDownload) Failed() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.done && d.err != nil
+}
+
+// Open returns a reader for the downloaded file. Reads past the data written
+// so far block until more arrives, and only reach EOF once the download has
+// finished.
+func (d *progressiveDownload) Open() (*progressiveReader, error) {
+	d.mu.Lock()
+	fileName := d.fileName
+	if !d.done {
+		fileName = d.partName
+	}
+	file, err := os.Open(fileName)
+	d.mu.Unlock()
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &progressiveReader{download: d, file: file}, nil
+}
+
+// progressiveReader reads a file while it is being downloaded.
+type progressiveReader struct {
+	download *progressiveDownload
+	file     *os.File
+	offset   int64
+	closed   bool
+}
+
+// wait blocks until there is data at the reader's offset or the download has
+// finished.
+func (r *progressiveReader) wait() error {
+	d := r.download
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for !d.done && !r.closed && d.size <= r.offset {
+		d.cond.Wait()
+	}
+
+	if r.closed {
+		return errReaderClosed
+	}
+	return d.err
+}
+
+func (r *progressiveReader) Read(p []byte) (int, error) {
+	for {
+		if err := r.wait(); err != nil {
+			return 0, err
+		}
+
+		n, err := r.file.Read(p)
+		r.offset += int64(n)
+		if n > 0 || err != io.EOF {
+			return n, err
+		}
+
+		// The size may have been updated before the data is readable.
+		r.download.mu.Lock()
+		done := r.download.done
+		r.download.mu.Unlock()
+
+		if done {
+			return 0, io.EOF
+		}
+	}
+}
+
+func (r *progressiveReader) Seek(offset int64, whence int) (int64, error) {
+	// The end of the file is only known once the download has finished.
+	if whence == io.SeekEnd {
+		if err := r.download.Wait(); err != nil {
+			return r.offset, err
+		}
+	}
+
+	pos, err := r.file.Seek(offset, whence)
+	if err != nil {
+		return r.offset, err
+	}
+
+	r.offset = pos
+	return pos, nil
+}
+
+// Close closes the file and wakes up a blocked Read.
+func (r *progressiveReader) Close() error {
+	r.download.mu.Lock()
+	r.closed = true
+	r.download.mu.Unlock()
+	r.download.cond.Broadcast()
+
+	return r.file.Close()
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"container/list"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultCacheDir  = "tmp"
+	defaultCacheSize = 1 << 30
+)
+
+// SongCache keeps downloaded songs on disk up to a maximum total size,
+// evicting the least recently used files first. Queue entries hold a
+// reference to the file they play, and referenced files are never evicted.
+// One cache is shared by every guild.
+type SongCache struct {
+	mu      sync.Mutex
+	dir     string
+	maxSize int64
+	size    int64
+	entries map[string]*cacheEntry
+	// lru orders the complete entries, most recently used first.
+	lru *list.List
+}
+
+type cacheEntry struct {
+	name     string
+	size     int64
+	refs     int
+	complete bool
+	element  *list.Element
+	// download is the download in progress for the entry, shared by every
+	// item that wants the file.
+	download *progressiveDownload
+}
+
+// NewSongCache creates dir if needed and indexes the files already in it, so
+// songs downloaded before a restart are reused.
+func NewSongCache(dir string, maxSize int64) *SongCache {
+	c := &SongCache{
+		dir:     dir,
+		maxSize: maxSize,
+		entries: make(map[string]*cacheEntry),
+		lru:     list.New(),
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		log.Printf("Failed to create song cache: %v", err)
+	}
+
+	if err := c.index(); err != nil {
+		log.Printf("Failed to index song cache: %v", err)
+	}
+
+	return c
+}
+
+// Path returns where the cached file name is stored.
+func (c *SongCache) Path(name string) string {
+	return filepath.Join(c.dir, name)
+}
+
+// Size returns the total size of the complete files in the cache.
+func (c *SongCache) Size() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.size
+}
+
+// Download returns the cached file name for item, starting fetch in the
+// background to download it if it is not cached yet. Only one download runs
+// per file; other callers share it. The item holds a reference to the file
+// until it is passed to Release. The caller must hold item.mu.
+func (c *SongCache) Download(item *PlaylistItem, name string, fetch func(w io.Writer) error) (*progressiveDownload, error) {
+	if item.download != nil && !item.download.Failed() && item.cacheName == name {
+		return item.download, nil
+	}
+
+	if item.cacheName != name {
+		if item.cacheName != "" {
+			c.release(item.cacheName)
+		}
+		item.cacheName = name
+		c.acquire(name)
+	}
+
+	download, started, err := c.startDownload(name)
+	if err != nil {
+		return nil, err
+	}
+	item.download = download
+
+	if started {
+		go func() {
+			err := fetch(download)
+			download.finish(err)
+			c.finishDownload(name, download)
+		}()
+	}
+
+	return download, nil
+}
+
+// Release drops the item's reference to its cached file, which may then be
+// evicted. The caller must hold item.mu.
+func (c *SongCache) Release(item *PlaylistItem) {
+	if item.cacheName == "" {
+		return
+	}
+
+	c.release(item.cacheName)
+	item.cacheName = ""
+	item.download = nil
+}
+
+// acquire references the entry for name, creating it if needed.
+func (c *SongCache) acquire(name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[name]
+	if !ok {
+		entry = &cacheEntry{name: name}
+		c.entries[name] = entry
+	}
+	entry.refs++
+
+	if entry.complete {
+		c.touch(entry)
+	}
+}
+
+// startDownload returns the download for name: a finished one if the file
+// is cached, the one in progress, or a new one that the caller must run, in
+// which case started is true.
+func (c *SongCache) startDownload(name string) (download *progressiveDownload, started bool, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[name]
+	if !ok {
+		entry = &cacheEntry{name: name}
+		c.entries[name] = entry
+	}
+
+	if entry.complete {
+		download, err = completedDownload(c.Path(name))
+		return download, false, err
+	}
+
+	if entry.download != nil && !entry.download.Failed() {
+		return entry.download, false, nil
+	}
+
+	download, err = newProgressiveDownload(c.Path(name))
+	if err != nil {
+		return nil, false, err
+	}
+	entry.download = download
+
+	return download, true, nil
+}
+
+func (c *SongCache) release(name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[name]
+	if !ok {
+		return
+	}
+
+	entry.refs--
+	if entry.refs <= 0 && !entry.complete && entry.download == nil {
+		delete(c.entries, name)
+	}
+
+	c.evict()
+}
+
+// finishDownload records the result of download, which has finished, for
+// name. A complete file is added to the cache. A failed download may already
+// have been replaced by a retry, which is left alone.
+func (c *SongCache) finishDownload(name string, download *progressiveDownload) {
+	err := download.Wait()
+
+	var info os.FileInfo
+	if err == nil {
+		info, err = os.Stat(c.Path(name))
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[name]
+	if !ok || entry.download != download {
+		return
+	}
+	entry.download = nil
+
+	if err != nil {
+		log.Printf("Failed to download %s: %v", name, err)
+		if entry.refs <= 0 && !entry.complete {
+			delete(c.entries, name)
+		}
+		return
+	}
+
+	if entry.complete {
+		c.size -= entry.size
+	} else {
+		entry.complete = true
+		entry.element = c.lru.PushFront(entry)
+	}
+
+	entry.size = info.Size()
+	c.size += entry.size
+	c.touch(entry)
+
+	c.evict()
+}
+
+// touch marks entry as the most recently used. The modification time of the
+// file is updated too, so the order survives a restart.
+func (c *SongCache) touch(entry *cacheEntry) {
+	c.lru.MoveToFront(entry.element)
+
+	now := time.Now()
+	os.Chtimes(c.Path(entry.name), now, now)
+}
+
+// evict removes unreferenced files, least recently used first, until the
+// cache fits in its maximum size.
+func (c *SongCache) evict() {
+	for e := c.lru.Back(); e != nil && c.size > c.maxSize; {
+		entry := e.Value.(*cacheEntry)
+		prev := e.Prev()
+
+		if entry.refs <= 0 {
+			if err := os.Remove(c.Path(entry.name)); err != nil && !os.IsNotExist(err) {
+				log.Printf("Failed to evict cached song: %v", err)
+			} else {
+				c.lru.Remove(e)
+				delete(c.entries, entry.name)
+				c.size -= entry.size
+			}
+		}
+
+		e = prev
+	}
+}
+
+// index adds the files in the cache directory, ordered by their modification
+// time. Partial files left behind by interrupted downloads are removed.
+func (c *SongCache) index() error {
+	files, err := ioutil.ReadDir(c.dir)
+	if err != nil {
+		return err
+	}
+
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].ModTime().After(files[j].ModTime())
+	})
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, info := range files {
+		if !info.Mode().IsRegular() {
+			continue
+		}
+
+		if strings.HasSuffix(info.Name(), partialSuffix) || info.Size() == 0 {
+			os.Remove(c.Path(info.Name()))
+			continue
+		}
+
+		entry := &cacheEntry{
+			name:     info.Name(),
+			size:     info.Size(),
+			complete: true,
+		}
+		entry.element = c.lru.PushBack(entry)
+		c.entries[entry.name] = entry
+		c.size += entry.size
+	}
+
+	c.evict()
+
+	return nil
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// downloadAll calls Download for every item at once. Fetches block until
+// every call has returned, then the downloads' errors are returned.
+func downloadAll(cache *SongCache, items []*PlaylistItem, fetch func(w io.Writer) error) []error {
+	gate := make(chan struct{})
+	gated := func(w io.Writer) error {
+		<-gate
+		return fetch(w)
+	}
+
+	downloads := make([]*progressiveDownload, len(items))
+	errs := make([]error, len(items))
+
+	var wg sync.WaitGroup
+	for i, item := range items {
+		wg.Add(1)
+		go func(i int, item *PlaylistItem) {
+			defer wg.Done()
+
+			item.mu.Lock()
+			downloads[i], errs[i] = cache.Download(item, "song.webm", gated)
+			item.mu.Unlock()
+		}(i, item)
+	}
+	wg.Wait()
+	close(gate)
+
+	for i, download := range downloads {
+		if errs[i] == nil {
+			errs[i] = download.Wait()
+		}
+	}
+
+	return errs
+}
+
+func TestSongCacheDownloadsOnce(t *testing.T) {
+	cache := NewSongCache(tempDir(t), 1<<20)
+
+	items := make([]*PlaylistItem, 10)
+	for i := range items {
+		items[i] = &PlaylistItem{}
+	}
+
+	var fetches int32
+	fetchErr := errors.New("connection lost")
+	fail := func(w io.Writer) error {
+		atomic.AddInt32(&fetches, 1)
+		return fetchErr
+	}
+	succeed := func(w io.Writer) error {
+		atomic.AddInt32(&fetches, 1)
+		_, err := w.Write([]byte("song"))
+		return err
+	}
+
+	for _, err := range downloadAll(cache, items, fail) {
+		if !errors.Is(err, fetchErr) {
+			t.Fatalf("download error = %v, want %v", err, fetchErr)
+		}
+	}
+	if fetches != 1 {
+		t.Fatalf("fetched %v times, want once", fetches)
+	}
+
+	// Every item retries the failed download, but only one fetch runs.
+	for _, err := range downloadAll(cache, items, succeed) {
+		if err != nil {
+			t.Fatalf("retried download failed: %v", err)
+		}
+	}
+	if fetches != 2 {
+		t.Errorf("fetched %v times, want twice", fetches)
+	}
+	if size := cache.Size(); size != 4 {
+		t.Errorf("cache size = %v, want 4", size)
+	}
+}
+
+func TestSongCacheIgnoresReplacedDownload(t *testing.T) {
+	cache := NewSongCache(tempDir(t), 1<<20)
+	cache.acquire("song.webm")
+
+	failed, _, err := cache.startDownload("song.webm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	failed.finish(errors.New("connection lost"))
+
+	// A retry starts before the failed download has been recorded.
+	retry, started, err := cache.startDownload("song.webm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !started {
+		t.Fatal("startDownload did not retry the failed download")
+	}
+	defer retry.finish(nil)
+
+	cache.finishDownload("song.webm", failed)
+
+	download, started, err := cache.startDownload("song.webm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if started || download != retry {
+		t.Error("recording the failed download dropped the retry in progress")
+	}
+}
+
+// writeCacheFile creates a file of size bytes in dir, last used at modTime.
+func writeCacheFile(t *testing.T, dir string, name string, size int, modTime time.Time) {
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, make([]byte, size), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// cacheSong downloads size bytes to name, leaving the file referenced.
+func cacheSong(t *testing.T, cache *SongCache, name string, size int) {
+	cache.acquire(name)
+
+	download, started, err := cache.startDownload(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !started {
+		t.Fatalf("%s is already cached", name)
+	}
+
+	download.Write(make([]byte, size))
+	download.finish(nil)
+	cache.finishDownload(name, download)
+}
+
+// cachedFiles returns the names of the files in dir.
+func cachedFiles(t *testing.T, dir string) []string {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	names := make([]string, len(files))
+	for i, file := range files {
+		names[i] = file.Name()
+	}
+	return names
+}
+
+func TestSongCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	dir := tempDir(t)
+	now := time.Now()
+	writeCacheFile(t, dir, "a", 4, now.Add(-3*time.Hour))
+	writeCacheFile(t, dir, "b", 4, now.Add(-2*time.Hour))
+	writeCacheFile(t, dir, "c", 4, now.Add(-time.Hour))
+
+	cache := NewSongCache(dir, 12)
+
+	// Playing a makes b the least recently used.
+	cache.acquire("a")
+	cache.release("a")
+
+	cacheSong(t, cache, "d", 4)
+	if got, want := cachedFiles(t, dir), []string{"a", "c", "d"}; !equalStrings(got, want) {
+		t.Errorf("cached files = %q, want %q", got, want)
+	}
+
+	cacheSong(t, cache, "e", 8)
+	if got, want := cachedFiles(t, dir), []string{"d", "e"}; !equalStrings(got, want) {
+		t.Errorf("cached files = %q, want %q", got, want)
+	}
+	if size := cache.Size(); size != 12 {
+		t.Errorf("cache size = %v, want 12", size)
+	}
+}
+
+func TestSongCacheKeepsReferencedFiles(t *testing.T) {
+	dir := tempDir(t)
+	writeCacheFile(t, dir, "a", 4, time.Now().Add(-time.Hour))
+
+	cache := NewSongCache(dir, 4)
+	cache.acquire("a")
+
+	// Both files are in use, so the cache goes over its size.
+	cacheSong(t, cache, "b", 4)
+	if got, want := cachedFiles(t, dir), []string{"a", "b"}; !equalStrings(got, want) {
+		t.Errorf("cached files = %q, want %q", got, want)
+	}
+	if size := cache.Size(); size != 8 {
+		t.Errorf("cache size = %v, want 8", size)
+	}
+
+	// Once b is released it goes, even though a is older.
+	cache.release("b")
+	if got, want := cachedFiles(t, dir), []string{"a"}; !equalStrings(got, want) {
+		t.Errorf("cached files = %q, want %q", got, want)
+	}
+}
+
+func TestNewSongCacheIndexesFiles(t *testing.T) {
+	dir := tempDir(t)
+	now := time.Now()
+	writeCacheFile(t, dir, "new", 4, now.Add(-time.Hour))
+	writeCacheFile(t, dir, "old", 4, now.Add(-2*time.Hour))
+	writeCacheFile(t, dir, "older", 4, now.Add(-3*time.Hour))
+	writeCacheFile(t, dir, "partial"+partialSuffix, 4, now)
+	writeCacheFile(t, dir, "empty", 0, now)
+
+	// Only the two most recently used files fit.
+	cache := NewSongCache(dir, 8)
+
+	if got, want := cachedFiles(t, dir), []string{"new", "old"}; !equalStrings(got, want) {
+		t.Errorf("cached files = %q, want %q", got, want)
+	}
+	if size := cache.Size(); size != 8 {
+		t.Errorf("cache size = %v, want 8", size)
+	}
+
+	// The indexed files are reused rather than downloaded again.
+	download, started, err := cache.startDownload("old")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if started {
+		t.Error("an indexed file was downloaded again")
+	}
+	if err := download.Wait(); err != nil {
+		t.Errorf("download of an indexed file failed: %v", err)
+	}
+}
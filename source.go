@@ -0,0 +1,143 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Source is a provider of playable audio, such as YouTube.
+type Source interface {
+	// Name identifies the source in logs and messages.
+	Name() string
+	// Handles reports whether the source understands input.
+	Handles(input string) bool
+	// Resolve turns input into one or more queue items. The returned items
+	// must have their Source set.
+	Resolve(input string) (*PlaylistInfo, error)
+	// Open starts streaming the Opus frames of item.
+	Open(item *PlaylistItem) (AudioStream, error)
+}
+
+// SongPreparer is implemented by sources that can fetch a song ahead of time
+// so it starts without delay once it reaches the front of the queue.
+type SongPreparer interface {
+	Prepare(item *PlaylistItem) error
+}
+
+// SongReleaser is implemented by sources that hold resources for a song, such
+// as a downloaded file, that can be freed once it leaves the queue.
+type SongReleaser interface {
+	Release(item *PlaylistItem) error
+}
+
+// ResolveProgress is told how many items of a large playlist have been loaded
+// so far, and how many are expected in total, or 0 if unknown.
+type ResolveProgress func(loaded int, total int)
+
+// ProgressResolver is implemented by sources that can report progress while
+// resolving playlists that take several requests to load.
+type ProgressResolver interface {
+	ResolveWithProgress(input string, progress ResolveProgress) (*PlaylistInfo, error)
+}
+
+// AudioStream delivers the Opus frames of a song.
+type AudioStream interface {
+	// Packets returns the frames in order. It is closed at the end of the song.
+	Packets() <-chan OpusPacket
+	// Seek moves the stream to position.
+	Seek(position time.Duration)
+	// Close stops the stream and releases its resources.
+	Close() error
+	// Err returns the error that ended the stream early, such as a failed
+	// download, or nil if the song played to its end. It is only meaningful
+	// once Packets has been closed.
+	Err() error
+}
+
+// OpusPacket is a single Opus frame and its position in the song. Timecode is
+// negative when the container does not say where the frame starts.
+type OpusPacket struct {
+	Data     []byte
+	Timecode time.Duration
+}
+
+// SourceRegistry picks the Source for a piece of user input. Sources are
+// consulted in the order they were registered.
+type SourceRegistry struct {
+	sync.RWMutex
+	sources []Source
+}
+
+func NewSourceRegistry(sources ...Source) *SourceRegistry {
+	return &SourceRegistry{
+		sources: sources,
+	}
+}
+
+func (r *SourceRegistry) Register(source Source) {
+	r.Lock()
+	defer r.Unlock()
+
+	r.sources = append(r.sources, source)
+}
+
+// Find returns the first source that handles input, or nil.
+func (r *SourceRegistry) Find(input string) Source {
+	r.RLock()
+	defer r.RUnlock()
+
+	for _, source := range r.sources {
+		if source.Handles(input) {
+			return source
+		}
+	}
+	return nil
+}
+
+// errNotHandled is returned, possibly wrapped, by a source that claimed input
+// but found out while resolving it that it is not for the source after all.
+// The registry then tries the next source that handles it.
+var errNotHandled = errors.New("input not handled")
+
+// Resolve turns input into queue items using the first source that handles it.
+func (r *SourceRegistry) Resolve(input string) (*PlaylistInfo, error) {
+	return r.resolve(input, func(source Source) (*PlaylistInfo, error) {
+		return source.Resolve(input)
+	})
+}
+
+// ResolveWithProgress is like Resolve, but reports progress if the source
+// supports it.
+func (r *SourceRegistry) ResolveWithProgress(input string, progress ResolveProgress) (*PlaylistInfo, error) {
+	return r.resolve(input, func(source Source) (*PlaylistInfo, error) {
+		if resolver, ok := source.(ProgressResolver); ok {
+			return resolver.ResolveWithProgress(input, progress)
+		}
+		return source.Resolve(input)
+	})
+}
+
+// resolve calls fn with each source that handles input in turn, until one of
+// them does not give up with errNotHandled.
+func (r *SourceRegistry) resolve(input string, fn func(Source) (*PlaylistInfo, error)) (*PlaylistInfo, error) {
+	r.RLock()
+	sources := append([]Source(nil), r.sources...)
+	r.RUnlock()
+
+	err := fmt.Errorf("nothing can play %s", input)
+	for _, source := range sources {
+		if !source.Handles(input) {
+			continue
+		}
+
+		info, resolveErr := fn(source)
+		if !errors.Is(resolveErr, errNotHandled) {
+			return info, resolveErr
+		}
+		err = resolveErr
+	}
+
+	return nil, err
+}
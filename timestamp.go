@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// parseTimestamp reads a position or offset as typed by a user. It accepts
+// clock notation ("1:23", "1:02:03"), Go durations ("30s", "1m30s") and a
+// bare number of seconds ("90").
+func parseTimestamp(s string) (time.Duration, error) {
+	s = strings.TrimSpace(s)
+
+	if strings.Contains(s, ":") {
+		parts := strings.Split(s, ":")
+		if len(parts) > 3 {
+			return 0, fmt.Errorf("invalid timestamp: %s", s)
+		}
+
+		var total time.Duration
+		for _, part := range parts {
+			v, err := strconv.Atoi(part)
+			if err != nil || v < 0 {
+				return 0, fmt.Errorf("invalid timestamp: %s", s)
+			}
+			total = total*60 + time.Duration(v)*time.Second
+		}
+		return total, nil
+	}
+
+	if v, err := strconv.Atoi(s); err == nil && v >= 0 {
+		return time.Duration(v) * time.Second, nil
+	}
+
+	d, err := time.ParseDuration(s)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("invalid timestamp: %s", s)
+	}
+	return d, nil
+}
+
+// formatTimestamp renders d in clock notation, only showing hours when needed.
+func formatTimestamp(d time.Duration) string {
+	if d < 0 {
+		d = 0
+	}
+
+	secs := int64(d / time.Second)
+	h, m, s := secs/3600, (secs/60)%60, secs%60
+
+	if h > 0 {
+		return fmt.Sprintf("%d:%02d:%02d", h, m, s)
+	}
+	return fmt.Sprintf("%d:%02d", m, s)
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseTimestamp(t *testing.T) {
+	tests := []struct {
+		input   string
+		want    time.Duration
+		wantErr bool
+	}{
+		{input: "1:02:03", want: time.Hour + 2*time.Minute + 3*time.Second},
+		{input: "2:03", want: 2*time.Minute + 3*time.Second},
+		{input: "0:00", want: 0},
+		{input: "90", want: 90 * time.Second},
+		{input: " 90 ", want: 90 * time.Second},
+		{input: "1m30s", want: 90 * time.Second},
+		{input: "30s", want: 30 * time.Second},
+		{input: "", wantErr: true},
+		{input: "-5", wantErr: true},
+		{input: "-1m", wantErr: true},
+		{input: "-1:00", wantErr: true},
+		{input: "1::2", wantErr: true},
+		{input: "1:2:3:4", wantErr: true},
+		{input: ":30", wantErr: true},
+		{input: "1:xx", wantErr: true},
+		{input: "soon", wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.input, func(t *testing.T) {
+			got, err := parseTimestamp(test.input)
+			if test.wantErr {
+				if err == nil {
+					t.Errorf("parseTimestamp(%q) = %v, want an error", test.input, got)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("parseTimestamp(%q): %v", test.input, err)
+			}
+			if got != test.want {
+				t.Errorf("parseTimestamp(%q) = %v, want %v", test.input, got, test.want)
+			}
+		})
+	}
+}
+
+func TestFormatTimestamp(t *testing.T) {
+	tests := []struct {
+		input time.Duration
+		want  string
+	}{
+		{input: 0, want: "0:00"},
+		{input: 90 * time.Second, want: "1:30"},
+		{input: 2*time.Minute + 3*time.Second + 900*time.Millisecond, want: "2:03"},
+		{input: time.Hour + 2*time.Minute + 3*time.Second, want: "1:02:03"},
+		{input: 25 * time.Hour, want: "25:00:00"},
+		{input: -time.Second, want: "0:00"},
+	}
+
+	for _, test := range tests {
+		if got := formatTimestamp(test.input); got != test.want {
+			t.Errorf("formatTimestamp(%v) = %q, want %q", test.input, got, test.want)
+		}
+	}
+}
@@ -1,13 +1,430 @@
-package main
-
-import (
-	"net/http"
-)
-
-type Client struct {
-	HTTPClient *http.Client
-}
-
-var DefaultClient = &Client{
-	HTTPClient: http.DefaultClient,
-}
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/rylio/ytdl"
+)
+
+type Client struct {
+	HTTPClient *http.Client
+	// Videos looks up video info and format URLs. Defaults to ytdl, which
+	// does its own requests without HTTPClient.
+	Videos VideoInfoProvider
+}
+
+var DefaultClient = &Client{
+	HTTPClient: newHTTPClient(httpResponseTimeout, httpIdleTimeout, checkPublicAddress),
+}
+
+const (
+	// httpResponseTimeout is how long a request waits for the response
+	// headers.
+	httpResponseTimeout = 30 * time.Second
+	// httpIdleTimeout is how long reading a response body may go without
+	// receiving anything.
+	httpIdleTimeout = 30 * time.Second
+)
+
+// newHTTPClient returns an HTTP client that gives up on a server that stops
+// responding instead of waiting forever. Only the wait for headers and the
+// gaps between reads are limited, as a long song may rightly take a while to
+// download.
+//
+// control, if not nil, is called before each connection is made with the
+// address it is made to. As it sees every connection, including those made
+// to follow redirects, it is where addresses are vetted.
+func newHTTPClient(responseTimeout, idleTimeout time.Duration, control func(network, address string, c syscall.RawConn) error) *http.Client {
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+		Control:   control,
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = dialer.DialContext
+	transport.ResponseHeaderTimeout = responseTimeout
+
+	return &http.Client{
+		Transport: &idleTimeoutTransport{base: transport, timeout: idleTimeout},
+	}
+}
+
+// errPrivateAddress is returned when a request would connect to an address
+// that is not public.
+var errPrivateAddress = errors.New("refusing to connect to a private address")
+
+// privateNetworks are the address ranges that are not reachable from the
+// internet, beyond loopback, link-local and unspecified addresses.
+var privateNetworks = []*net.IPNet{
+	mustParseCIDR("10.0.0.0/8"),
+	mustParseCIDR("172.16.0.0/12"),
+	mustParseCIDR("192.168.0.0/16"),
+	mustParseCIDR("100.64.0.0/10"),
+	mustParseCIDR("fc00::/7"),
+}
+
+func mustParseCIDR(s string) *net.IPNet {
+	_, network, err := net.ParseCIDR(s)
+	if err != nil {
+		panic(err)
+	}
+	return network
+}
+
+// checkPublicAddress is a net.Dialer Control function that refuses to connect
+// to loopback, link-local and private addresses, so that a link posted in chat
+// cannot reach the bot's own machine or network. It is given the resolved
+// address, so host names that resolve to a private address are refused too.
+func checkPublicAddress(network, address string, c syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return fmt.Errorf("%w: %s", errPrivateAddress, host)
+	}
+
+	if ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsUnspecified() {
+		return fmt.Errorf("%w: %s", errPrivateAddress, host)
+	}
+	for _, private := range privateNetworks {
+		if private.Contains(ip) {
+			return fmt.Errorf("%w: %s", errPrivateAddress, host)
+		}
+	}
+
+	return nil
+}
+
+// errBodyIdle is returned by reads from a response body that has stopped
+// receiving data.
+var errBodyIdle = errors.New("no data received")
+
+// idleTimeoutTransport closes response bodies that go too long without
+// receiving data, so that a stalled read fails rather than hangs.
+type idleTimeoutTransport struct {
+	base    http.RoundTripper
+	timeout time.Duration
+}
+
+func (t *idleTimeoutTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+
+	body := &idleTimeoutBody{body: resp.Body, timeout: t.timeout}
+	body.timer = time.AfterFunc(t.timeout, body.expire)
+	resp.Body = body
+
+	return resp, nil
+}
+
+type idleTimeoutBody struct {
+	body    io.ReadCloser
+	timeout time.Duration
+	timer   *time.Timer
+
+	mu      sync.Mutex
+	expired bool
+}
+
+func (b *idleTimeoutBody) expire() {
+	b.mu.Lock()
+	b.expired = true
+	b.mu.Unlock()
+
+	b.body.Close()
+}
+
+func (b *idleTimeoutBody) Read(p []byte) (int, error) {
+	n, err := b.body.Read(p)
+
+	b.mu.Lock()
+	expired := b.expired
+	b.mu.Unlock()
+
+	if expired {
+		return n, fmt.Errorf("%w for %v", errBodyIdle, b.timeout)
+	}
+	if n > 0 {
+		b.timer.Reset(b.timeout)
+	}
+	return n, err
+}
+
+func (b *idleTimeoutBody) Close() error {
+	b.timer.Stop()
+	return b.body.Close()
+}
+
+// VideoInfoProvider looks up YouTube videos and the download URLs of their
+// formats.
+type VideoInfoProvider interface {
+	GetVideoInfo(id string) (*ytdl.VideoInfo, error)
+	GetDownloadURL(info *ytdl.VideoInfo, format *ytdl.Format) (*url.URL, error)
+}
+
+// ytdlVideoInfoProvider is the VideoInfoProvider backed by ytdl.
+type ytdlVideoInfoProvider struct{}
+
+func (ytdlVideoInfoProvider) GetVideoInfo(id string) (*ytdl.VideoInfo, error) {
+	return ytdl.GetVideoInfoFromID(id)
+}
+
+func (ytdlVideoInfoProvider) GetDownloadURL(info *ytdl.VideoInfo, format *ytdl.Format) (*url.URL, error) {
+	return info.GetDownloadURL(format)
+}
+
+func (c *Client) videos() VideoInfoProvider {
+	if c.Videos == nil {
+		return ytdlVideoInfoProvider{}
+	}
+	return c.Videos
+}
+
+// GetVideoInfo looks up the video with the given ID.
+func (c *Client) GetVideoInfo(id string) (*ytdl.VideoInfo, error) {
+	return c.videos().GetVideoInfo(id)
+}
+
+// GetDownloadURL returns where format of a video can be downloaded from.
+func (c *Client) GetDownloadURL(info *ytdl.VideoInfo, format *ytdl.Format) (*url.URL, error) {
+	return c.videos().GetDownloadURL(info, format)
+}
+
+func (c *Client) httpHead(url string) (*http.Response, error) {
+	req, err := http.NewRequest("HEAD", url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.HTTPClient.Do(req)
+}
+
+const downloadAttempts = 5
+
+// downloadRetryDelay is how long the first retry of a download waits. It is a
+// var so tests do not have to wait.
+var downloadRetryDelay = time.Second
+
+// DownloadErrorKind classifies why a download failed.
+type DownloadErrorKind int
+
+const (
+	// DownloadNetworkError covers connection problems and unexpected
+	// responses, which are worth retrying.
+	DownloadNetworkError DownloadErrorKind = iota
+	// DownloadExpired means the server refused the URL, which happens when a
+	// signed YouTube format URL has expired.
+	DownloadExpired
+	// DownloadNotFound means the file does not exist.
+	DownloadNotFound
+)
+
+func (k DownloadErrorKind) String() string {
+	switch k {
+	case DownloadNetworkError:
+		return "network error"
+	case DownloadExpired:
+		return "expired URL"
+	case DownloadNotFound:
+		return "not found"
+	}
+	return "unknown error"
+}
+
+// DownloadError is returned when a download fails for good.
+type DownloadError struct {
+	Kind       DownloadErrorKind
+	StatusCode int
+	Err        error
+}
+
+func (e *DownloadError) Error() string {
+	return fmt.Sprintf("download failed (%v): %v", e.Kind, e.Err)
+}
+
+func (e *DownloadError) Unwrap() error {
+	return e.Err
+}
+
+func classifyDownloadError(err error) *DownloadError {
+	var downloadErr *DownloadError
+	if errors.As(err, &downloadErr) {
+		return downloadErr
+	}
+	return &DownloadError{Kind: DownloadNetworkError, Err: err}
+}
+
+func statusDownloadError(statusCode int) *DownloadError {
+	err := &DownloadError{
+		Kind:       DownloadNetworkError,
+		StatusCode: statusCode,
+		Err:        fmt.Errorf("unexpected status code: %v", statusCode),
+	}
+
+	switch statusCode {
+	case http.StatusForbidden, http.StatusGone:
+		err.Kind = DownloadExpired
+	case http.StatusNotFound:
+		err.Kind = DownloadNotFound
+	}
+
+	return err
+}
+
+// resumableDownload copies a file to w, retrying with exponential backoff and
+// resuming from the bytes already written. resolve returns the URL to fetch;
+// it is called again with refresh set after the URL has expired.
+func (c *Client) resumableDownload(resolve func(refresh bool) (string, error), w io.Writer) error {
+	var written int64
+	var url string
+	refresh := false
+	delay := downloadRetryDelay
+
+	backoff := func(reason string, err error) {
+		log.Printf("%s, retrying in %v: %v", reason, delay, err)
+		time.Sleep(delay)
+		delay *= 2
+	}
+
+	for attempt := 1; ; attempt++ {
+		next, err := resolve(refresh)
+		if err == nil {
+			// Only a new URL is worth trying straight away; the same one
+			// is likely to be refused again.
+			if refresh && next == url {
+				backoff("Download URL expired", errors.New("resolved to the same URL"))
+			}
+			url = next
+
+			var n int64
+			n, err = c.httpDownloadFrom(url, w, written)
+			written += n
+			if err == nil {
+				return nil
+			}
+		}
+
+		downloadErr := classifyDownloadError(err)
+		if downloadErr.Kind == DownloadNotFound || attempt >= downloadAttempts {
+			return downloadErr
+		}
+
+		refresh = downloadErr.Kind == DownloadExpired
+		if !refresh {
+			backoff("Download interrupted", err)
+		}
+	}
+}
+
+// httpDownloadFrom copies the body of url to w, starting offset bytes in. It
+// returns the number of bytes written.
+func (c *Client) httpDownloadFrom(url string, w io.Writer, offset int64) (int64, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusOK:
+		// The server ignored the range, so skip what we already have.
+		if offset > 0 {
+			if _, err := io.CopyN(ioutil.Discard, resp.Body, offset); err != nil {
+				return 0, fmt.Errorf("request failed: %w", err)
+			}
+		}
+	default:
+		return 0, statusDownloadError(resp.StatusCode)
+	}
+
+	n, err := io.Copy(w, resp.Body)
+	if err != nil {
+		return n, fmt.Errorf("download failed: %w", err)
+	}
+
+	return n, nil
+}
+
+// httpGetRange returns up to length bytes of url starting at offset, and the
+// size of the whole file, or 0 if the server does not say. A server that
+// ignores the range is only accepted for reads from the start of the file.
+func (c *Client) httpGetRange(url string, offset, length int64) ([]byte, int64, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+length-1))
+
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return nil, 0, fmt.Errorf("request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	size := resp.ContentLength
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		size = contentRangeSize(resp.Header.Get("Content-Range"))
+	case http.StatusOK:
+		if offset > 0 {
+			return nil, 0, fmt.Errorf("server does not support range requests")
+		}
+	default:
+		return nil, 0, statusDownloadError(resp.StatusCode)
+	}
+
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, length))
+	if err != nil {
+		return nil, 0, fmt.Errorf("request failed: %w", err)
+	}
+
+	if size < 0 {
+		size = 0
+	}
+
+	return data, size, nil
+}
+
+// contentRangeSize reads the size of the whole file from a Content-Range
+// header such as "bytes 0-1023/4096", or returns 0 if it is unknown.
+func contentRangeSize(header string) int64 {
+	i := strings.LastIndex(header, "/")
+	if i < 0 {
+		return 0
+	}
+
+	size, err := strconv.ParseInt(header[i+1:], 10, 64)
+	if err != nil {
+		return 0
+	}
+	return size
+}
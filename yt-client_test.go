@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func setDownloadRetryDelay(t *testing.T, delay time.Duration) {
+	previous := downloadRetryDelay
+	downloadRetryDelay = delay
+	t.Cleanup(func() {
+		downloadRetryDelay = previous
+	})
+}
+
+func TestResumableDownloadBacksOffWhenURLStaysExpired(t *testing.T) {
+	setDownloadRetryDelay(t, 10*time.Millisecond)
+
+	var log requestLog
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		log.add(r)
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer server.Close()
+
+	client := &Client{HTTPClient: http.DefaultClient}
+	refreshes := 0
+
+	start := time.Now()
+	err := client.resumableDownload(func(refresh bool) (string, error) {
+		if refresh {
+			refreshes++
+		}
+		return server.URL, nil
+	}, &bytes.Buffer{})
+	elapsed := time.Since(start)
+
+	var downloadErr *DownloadError
+	if !errors.As(err, &downloadErr) || downloadErr.Kind != DownloadExpired {
+		t.Fatalf("err = %v, want an expired URL error", err)
+	}
+
+	if got := len(log.get()); got != downloadAttempts {
+		t.Errorf("made %v requests, want %v", got, downloadAttempts)
+	}
+	if refreshes != downloadAttempts-1 {
+		t.Errorf("refreshed %v times, want %v", refreshes, downloadAttempts-1)
+	}
+
+	// 10ms + 20ms + 40ms + 80ms between the attempts.
+	if want := 150 * time.Millisecond; elapsed < want {
+		t.Errorf("gave up after %v, want at least %v of backoff", elapsed, want)
+	}
+}
+
+func TestResumableDownloadRetriesRefreshedURLImmediately(t *testing.T) {
+	setDownloadRetryDelay(t, 2*time.Second)
+
+	data := readTestData(t, "tone.webm")
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/expired" {
+			w.WriteHeader(http.StatusGone)
+			return
+		}
+		serveAudio("video/webm", data)(w, r)
+	}))
+	defer server.Close()
+
+	client := &Client{HTTPClient: http.DefaultClient}
+
+	var got bytes.Buffer
+	start := time.Now()
+	err := client.resumableDownload(func(refresh bool) (string, error) {
+		if refresh {
+			return server.URL + "/fresh", nil
+		}
+		return server.URL + "/expired", nil
+	}, &got)
+	if err != nil {
+		t.Fatalf("resumableDownload: %v", err)
+	}
+
+	if elapsed := time.Since(start); elapsed >= downloadRetryDelay {
+		t.Errorf("took %v, want the refreshed URL tried without a backoff", elapsed)
+	}
+	if !bytes.Equal(got.Bytes(), data) {
+		t.Errorf("downloaded %v bytes that differ from the %v served", got.Len(), len(data))
+	}
+}
+
+func TestResumableDownloadRetriesStalledRequests(t *testing.T) {
+	setDownloadRetryDelay(t, time.Millisecond)
+
+	data := readTestData(t, "tone.webm")
+	tests := []struct {
+		name  string
+		stall func(w http.ResponseWriter)
+	}{
+		{
+			name:  "headers",
+			stall: func(w http.ResponseWriter) {},
+		},
+		{
+			name: "body",
+			stall: func(w http.ResponseWriter) {
+				w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+				w.Write(data[:len(data)/2])
+				w.(http.Flusher).Flush()
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			done := make(chan struct{})
+			var log requestLog
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				log.add(r)
+				if len(log.get()) == 1 {
+					test.stall(w)
+					<-done
+					return
+				}
+				serveAudio("video/webm", data)(w, r)
+			}))
+			defer server.Close()
+			defer close(done)
+
+			client := &Client{HTTPClient: newHTTPClient(100*time.Millisecond, 100*time.Millisecond, nil)}
+
+			var got bytes.Buffer
+			err := client.resumableDownload(func(refresh bool) (string, error) {
+				return server.URL, nil
+			}, &got)
+			if err != nil {
+				t.Fatalf("resumableDownload: %v", err)
+			}
+
+			if n := len(log.get()); n != 2 {
+				t.Errorf("made %v requests, want 2", n)
+			}
+			if !bytes.Equal(got.Bytes(), data) {
+				t.Errorf("downloaded %v bytes that differ from the %v served", got.Len(), len(data))
+			}
+		})
+	}
+}
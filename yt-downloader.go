@@ -1,162 +1,228 @@
-package main
-
-import (
-	"fmt"
-	"net/url"
-	"os"
-	"strings"
-
-	"github.com/ebml-go/webm"
-	"github.com/rylio/ytdl"
-)
-
-func PrepareSong(item *PlaylistItem) error {
-	if item.VideoInfo == nil {
-		vid, err := getVideoFromID(item.VideoID)
-		if err != nil {
-			return err
-		}
-
-		item.VideoInfo = vid
-	}
-
-	dlFormat := item.GetSongFormat()
-	if dlFormat == nil {
-		return fmt.Errorf("No suitable audio formats found")
-	}
-
-	fileName := getFileName(item)
-	if fileExists(fileName) {
-		return nil
-	}
-
-	os.Mkdir("tmp", os.ModeTemporary)
-	file, _ := os.Create(fileName)
-	err := item.VideoInfo.Download(dlFormat, file)
-	if err != nil {
-		return err
-	}
-
-	return nil
-}
-
-func GetSongFile(item *PlaylistItem) (*os.File, error) {
-	fileName := getFileName(item)
-
-	file, err := os.Open(fileName)
-	if err != nil {
-		return nil, err
-	}
-
-	return file, nil
-}
-
-func LoadSong(file *os.File) (*webm.Reader, error) {
-	var w webm.WebM
-	reader, err := webm.Parse(file, &w)
-	return reader, err
-}
-
-func RemoveSong(item *PlaylistItem) error {
-	fileName := getFileName(item)
-
-	if fileName != "" && fileExists(fileName) {
-		return os.Remove(fileName)
-	}
-	return nil
-}
-
-func getPlaylistInfoFromURL(surl string) (*PlaylistInfo, error) {
-	playlistURL, err := url.ParseRequestURI(surl)
-	if err != nil {
-		return nil, err
-	}
-
-	plID := extractPlaylistID(playlistURL)
-
-	if plID == "" {
-		return nil, nil
-	}
-
-	playlistInfo, err := DefaultClient.GetPlaylistInfoFromID(plID)
-	if err != nil {
-		return nil, err
-	}
-
-	return playlistInfo, nil
-}
-
-func getVideoFromURL(surl string) (*ytdl.VideoInfo, error) {
-	videoURL, err := url.ParseRequestURI(surl)
-	if err != nil {
-		return nil, err
-	}
-
-	vID := extractVideoID(videoURL)
-
-	if vID == "" {
-		return nil, nil
-	}
-
-	return getVideoFromID(vID)
-}
-
-func getVideoFromID(id string) (*ytdl.VideoInfo, error) {
-	videoInfo, err := ytdl.GetVideoInfoFromID(id)
-	if err != nil {
-		return nil, err
-	}
-
-	return videoInfo, nil
-}
-
-func extractVideoID(u *url.URL) string {
-	switch u.Host {
-	case "www.youtube.com", "youtube.com", "m.youtube.com":
-		if u.Path == "/watch" {
-			return u.Query().Get("v")
-		}
-		if strings.HasPrefix(u.Path, "/embed/") {
-			return u.Path[7:]
-		}
-	case "youtu.be":
-		if len(u.Path) > 1 {
-			return u.Path[1:]
-		}
-	}
-	return ""
-}
-
-func extractPlaylistID(u *url.URL) string {
-	switch u.Host {
-	case "www.youtube.com", "youtube.com", "m.youtube.com":
-		if u.Path == "/playlist" {
-			return u.Query().Get("list")
-		}
-	}
-	return ""
-}
-
-func fileExists(filename string) bool {
-	info, err := os.Stat(filename)
-	if os.IsNotExist(err) {
-		return false
-	}
-	return !info.IsDir() && info.Size() > 0
-}
-
-func getFileName(item *PlaylistItem) string {
-	return fmt.Sprintf("tmp/%s.%s", item.VideoID, item.GetSongFormat().Extension)
-}
-
-func (vi *PlaylistItem) GetSongFormat() *ytdl.Format {
-	var dlFormat *ytdl.Format
-	if vi.VideoInfo != nil {
-		for _, f := range vi.VideoInfo.Formats {
-			if f.AudioEncoding == "opus" && (dlFormat == nil || f.AudioBitrate > dlFormat.AudioBitrate) {
-				dlFormat = f
-			}
-		}
-	}
-	return dlFormat
-}
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/rylio/ytdl"
+)
+
+// PrepareSong downloads the item's audio into cache and waits for the
+// download to finish.
+func PrepareSong(client *Client, cache *SongCache, item *PlaylistItem) error {
+	download, err := startSongDownload(client, cache, item)
+	if err != nil {
+		return err
+	}
+
+	return download.Wait()
+}
+
+// startSongDownload starts downloading the item's audio into cache in the
+// background, unless it is already cached or being downloaded. The returned
+// download can be read while it is still in progress.
+func startSongDownload(client *Client, cache *SongCache, item *PlaylistItem) (*progressiveDownload, error) {
+	item.mu.Lock()
+	defer item.mu.Unlock()
+
+	if item.VideoInfo == nil {
+		vid, err := client.GetVideoInfo(item.VideoID)
+		if err != nil {
+			return nil, err
+		}
+
+		item.VideoInfo = vid
+	}
+
+	dlFormat := item.GetSongFormat()
+	if dlFormat == nil {
+		return nil, fmt.Errorf("No suitable audio formats found")
+	}
+
+	videoInfo := item.VideoInfo
+	return cache.Download(item, getFileName(item), func(w io.Writer) error {
+		return client.resumableDownload(func(refresh bool) (string, error) {
+			if refresh {
+				var err error
+				if videoInfo, dlFormat, err = refreshSongFormat(client, item, dlFormat); err != nil {
+					return "", err
+				}
+			}
+
+			u, err := client.GetDownloadURL(videoInfo, dlFormat)
+			if err != nil {
+				return "", err
+			}
+			return u.String(), nil
+		}, w)
+	})
+}
+
+// refreshSongFormat fetches the item's video info again after the signed URL
+// of a format has expired, and finds the same format in it so a download can
+// be resumed.
+func refreshSongFormat(client *Client, item *PlaylistItem, format *ytdl.Format) (*ytdl.VideoInfo, *ytdl.Format, error) {
+	vid, err := client.GetVideoInfo(item.VideoID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	item.mu.Lock()
+	item.VideoInfo = vid
+	item.mu.Unlock()
+
+	for _, f := range vid.Formats {
+		if f.Itag.Number == format.Itag.Number {
+			return vid, f, nil
+		}
+	}
+
+	return nil, nil, fmt.Errorf("format %v is no longer available", format.Itag.Number)
+}
+
+// errUnsupportedAudio is returned by LoadSong for files that are not Opus in
+// a WebM or Ogg container.
+var errUnsupportedAudio = errors.New("unsupported audio format")
+
+var webmMagic = []byte{0x1a, 0x45, 0xdf, 0xa3}
+
+// LoadSong starts streaming the Opus frames in file, picking the demuxer from
+// the file header. On success the stream takes ownership of file and closes
+// it when it is closed.
+func LoadSong(file io.ReadSeeker) (AudioStream, error) {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(file, header); err != nil {
+		return nil, err
+	}
+
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	switch {
+	case bytes.Equal(header, webmMagic):
+		return newWebmStream(file)
+	case bytes.Equal(header, oggCapturePattern):
+		return newOggStream(file)
+	}
+
+	return nil, errUnsupportedAudio
+}
+
+// openAudioFile streams fileName natively when it holds Opus and transcodes
+// it with ffmpeg otherwise.
+func openAudioFile(fileName string) (AudioStream, error) {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	stream, err := LoadSong(file)
+	if err == nil {
+		return stream, nil
+	}
+	file.Close()
+
+	if err != errUnsupportedAudio {
+		return nil, err
+	}
+
+	return newFFmpegStream(fileName)
+}
+
+// openDownload streams a download that may still be in progress. Audio that
+// has to be transcoded is piped into ffmpeg as it arrives.
+func openDownload(download *progressiveDownload) (AudioStream, error) {
+	file, err := download.Open()
+	if err != nil {
+		return nil, err
+	}
+
+	stream, err := LoadSong(file)
+	if err == nil {
+		return stream, nil
+	}
+	file.Close()
+
+	if err != errUnsupportedAudio {
+		return nil, err
+	}
+
+	return newFFmpegPipeStream(func() (io.ReadCloser, error) {
+		r, err := download.Open()
+		if err != nil {
+			return nil, err
+		}
+		return r, nil
+	})
+}
+
+// RemoveSong releases the item's reference to its file in cache.
+func RemoveSong(cache *SongCache, item *PlaylistItem) error {
+	item.mu.Lock()
+	defer item.mu.Unlock()
+
+	cache.Release(item)
+	return nil
+}
+
+// getFileName is the name of the item's file in the song cache.
+func getFileName(item *PlaylistItem) string {
+	return fmt.Sprintf("%s.%s", item.VideoID, item.GetSongFormat().Extension)
+}
+
+// clone copies the item's metadata into a new queue entry without an entry ID.
+func (vi *PlaylistItem) clone() *PlaylistItem {
+	vi.mu.Lock()
+	defer vi.mu.Unlock()
+
+	return &PlaylistItem{
+		VideoID:      vi.VideoID,
+		Title:        vi.Title,
+		Duration:     vi.Duration,
+		IsPlayable:   vi.IsPlayable,
+		ThumbnailURL: vi.ThumbnailURL,
+		PageURL:      vi.PageURL,
+		VideoInfo:    vi.VideoInfo,
+		Source:       vi.Source,
+		RequestedBy:  vi.RequestedBy,
+	}
+}
+
+// GetSongFormat picks the format to download for the item. Opus formats can
+// be played without transcoding and are preferred; otherwise the best audio
+// format is used, favouring audio only streams over ones that carry video.
+func (vi *PlaylistItem) GetSongFormat() *ytdl.Format {
+	var dlFormat *ytdl.Format
+	if vi.VideoInfo != nil {
+		for _, f := range vi.VideoInfo.Formats {
+			if f.AudioEncoding == "opus" && (dlFormat == nil || f.AudioBitrate > dlFormat.AudioBitrate) {
+				dlFormat = f
+			}
+		}
+
+		if dlFormat != nil {
+			return dlFormat
+		}
+
+		for _, f := range vi.VideoInfo.Formats {
+			if f.AudioEncoding != "" && (dlFormat == nil || betterFallbackFormat(f, dlFormat)) {
+				dlFormat = f
+			}
+		}
+	}
+	return dlFormat
+}
+
+func betterFallbackFormat(f *ytdl.Format, current *ytdl.Format) bool {
+	audioOnly := f.VideoEncoding == ""
+	currentAudioOnly := current.VideoEncoding == ""
+
+	if audioOnly != currentAudioOnly {
+		return audioOnly
+	}
+	return f.AudioBitrate > current.AudioBitrate
+}
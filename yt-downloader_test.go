@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// fakeFFmpeg points ffmpegPath at a script that copies its stdin to its
+// stdout, so whatever is piped into it comes back out as PCM.
+func fakeFFmpeg(t *testing.T) {
+	path := filepath.Join(tempDir(t), "ffmpeg")
+	if err := ioutil.WriteFile(path, []byte("#!/bin/sh\nexec cat\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	previous := ffmpegPath
+	ffmpegPath = path
+	t.Cleanup(func() {
+		ffmpegPath = previous
+	})
+}
+
+// pcmFrame is 20ms of silence in the format ffmpeg is asked to output. It
+// does not start with a WebM or Ogg header, so it is transcoded.
+var pcmFrame = make([]byte, opusFrameSize*opusChannels*2)
+
+func newTestDownload(t *testing.T) *progressiveDownload {
+	download, err := newProgressiveDownload(filepath.Join(tempDir(t), "song.mp3"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return download
+}
+
+func receivePacket(t *testing.T, stream AudioStream) (OpusPacket, bool) {
+	select {
+	case packet, ok := <-stream.Packets():
+		return packet, ok
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for a packet")
+	}
+	return OpusPacket{}, false
+}
+
+func TestOpenDownloadTranscodesWhileDownloading(t *testing.T) {
+	fakeFFmpeg(t)
+	download := newTestDownload(t)
+
+	download.Write(pcmFrame)
+	download.Write(pcmFrame)
+
+	stream, err := openDownload(download)
+	if err != nil {
+		t.Fatalf("openDownload: %v", err)
+	}
+	defer stream.Close()
+
+	if _, ok := receivePacket(t, stream); !ok {
+		t.Fatal("stream ended before the download finished")
+	}
+
+	download.Write(pcmFrame)
+	download.finish(nil)
+
+	count := 1
+	for {
+		packet, ok := receivePacket(t, stream)
+		if !ok {
+			break
+		}
+		if want := time.Duration(count) * opusFrameDuration; packet.Timecode != want {
+			t.Errorf("packet %v timecode = %v, want %v", count, packet.Timecode, want)
+		}
+		count++
+	}
+
+	if count != 3 {
+		t.Errorf("got %v packets, want 3", count)
+	}
+	if err := stream.Err(); err != nil {
+		t.Errorf("Err = %v, want nil", err)
+	}
+}
+
+func TestOpenDownloadReportsFailedDownload(t *testing.T) {
+	fakeFFmpeg(t)
+	download := newTestDownload(t)
+	download.Write(pcmFrame)
+
+	stream, err := openDownload(download)
+	if err != nil {
+		t.Fatalf("openDownload: %v", err)
+	}
+	defer stream.Close()
+
+	receivePacket(t, stream)
+
+	downloadErr := errors.New("connection lost")
+	download.finish(downloadErr)
+
+	for {
+		if _, ok := receivePacket(t, stream); !ok {
+			break
+		}
+	}
+
+	if err := stream.Err(); !errors.Is(err, downloadErr) {
+		t.Errorf("Err = %v, want %v", err, downloadErr)
+	}
+}
+
+func TestOpenDownloadCloseWhileDownloading(t *testing.T) {
+	fakeFFmpeg(t)
+	download := newTestDownload(t)
+	defer download.finish(nil)
+	download.Write(pcmFrame)
+
+	stream, err := openDownload(download)
+	if err != nil {
+		t.Fatalf("openDownload: %v", err)
+	}
+
+	receivePacket(t, stream)
+
+	closed := make(chan bool)
+	go func() {
+		stream.Close()
+		close(closed)
+	}()
+
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close blocked on the unfinished download")
+	}
+}
+
+func TestLoadSongPicksDemuxer(t *testing.T) {
+	vorbis := bytes.Replace(readTestData(t, "tone.opus"), opusHeadMagic, []byte("Vorbis\x00\x00"), 1)
+
+	tests := []struct {
+		name    string
+		data    []byte
+		want    AudioStream
+		wantErr error
+	}{
+		{name: "webm", data: readTestData(t, "tone.webm"), want: &webmStream{}},
+		{name: "ogg", data: readTestData(t, "tone.opus"), want: &oggStream{}},
+		{name: "ogg vorbis", data: vorbis, wantErr: errUnsupportedAudio},
+		{name: "pcm", data: pcmFrame, wantErr: errUnsupportedAudio},
+		{name: "short", data: []byte("Ogg"), wantErr: io.ErrUnexpectedEOF},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			stream, err := LoadSong(bytes.NewReader(test.data))
+			if test.wantErr != nil {
+				if err != test.wantErr {
+					t.Errorf("err = %v, want %v", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("LoadSong: %v", err)
+			}
+			defer stream.Close()
+
+			if got, want := fmt.Sprintf("%T", stream), fmt.Sprintf("%T", test.want); got != want {
+				t.Errorf("stream is a %s, want a %s", got, want)
+			}
+
+			count := 0
+			for range stream.Packets() {
+				count++
+			}
+			if count != 50 {
+				t.Errorf("got %v packets, want 50", count)
+			}
+		})
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// initialDataName is how YouTube pages name the data the page is rendered
+// from. It has been embedded as window["ytInitialData"] = {...}, as
+// var ytInitialData = {...}, and as a JSON script tag with that id.
+var initialDataName = []byte("ytInitialData")
+
+// maxInitialDataGap is how far after the name the object may start.
+const maxInitialDataGap = 64
+
+// ErrNoInitialData is returned for pages that do not embed ytInitialData.
+var ErrNoInitialData = errors.New("no ytInitialData found on the page")
+
+// LayoutError is returned when the data of a page lacks what was looked for,
+// which usually means YouTube has changed the page layout.
+type LayoutError struct {
+	Page    string
+	Missing string
+}
+
+func (e *LayoutError) Error() string {
+	return fmt.Sprintf("unexpected %s page layout: no %s found", e.Page, e.Missing)
+}
+
+// UnavailableError is returned when YouTube shows an alert instead of the
+// content, such as for a private or deleted playlist.
+type UnavailableError struct {
+	Reason string
+}
+
+func (e *UnavailableError) Error() string {
+	return e.Reason
+}
+
+// extractInitialData finds the ytInitialData object in a page. Mentions of
+// the name that are not followed by an object are skipped.
+func extractInitialData(html []byte) (json.RawMessage, error) {
+	offset := 0
+	for {
+		i := bytes.Index(html[offset:], initialDataName)
+		if i < 0 {
+			return nil, ErrNoInitialData
+		}
+		offset += i + len(initialDataName)
+
+		end := offset + maxInitialDataGap
+		if end > len(html) {
+			end = len(html)
+		}
+
+		j := bytes.IndexByte(html[offset:end], '{')
+		if j < 0 {
+			continue
+		}
+
+		// Only an assignment or the rest of a script tag may come between
+		// the name and the object, not other code.
+		if bytes.ContainsAny(html[offset:offset+j], ";()") {
+			continue
+		}
+
+		var data json.RawMessage
+		if err := json.NewDecoder(bytes.NewReader(html[offset+j:])).Decode(&data); err == nil {
+			return data, nil
+		}
+	}
+}
+
+// findRenderers walks a decoded JSON tree and returns the value of every key
+// called name, without descending into the values found. Array elements are
+// visited in order; object keys are visited in sorted order.
+func findRenderers(node interface{}, name string) []interface{} {
+	var found []interface{}
+
+	switch v := node.(type) {
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			if key == name {
+				found = append(found, v[key])
+				continue
+			}
+			found = append(found, findRenderers(v[key], name)...)
+		}
+	case []interface{}:
+		for _, child := range v {
+			found = append(found, findRenderers(child, name)...)
+		}
+	}
+
+	return found
+}
+
+// decodeRenderer converts a part of a decoded JSON tree into v.
+func decodeRenderer(node interface{}, v interface{}) error {
+	data, err := json.Marshal(node)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// findAlert returns the text of the first alert on a page, if any.
+func findAlert(tree interface{}) string {
+	for _, name := range []string{"alertRenderer", "alertWithButtonRenderer"} {
+		for _, node := range findRenderers(tree, name) {
+			var alert struct {
+				Text formattedText `json:"text"`
+			}
+			if err := decodeRenderer(node, &alert); err == nil && alert.Text.String() != "" {
+				return alert.Text.String()
+			}
+		}
+	}
+	return ""
+}
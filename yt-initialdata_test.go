@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// checkGolden compares got, encoded as JSON, with the golden file at path.
+// Run the tests with -update to rewrite the file instead.
+func checkGolden(t *testing.T, path string, got interface{}) {
+	t.Helper()
+
+	data, err := json.MarshalIndent(got, "", "\t")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data = append(data, '\n')
+
+	if *update {
+		if err := ioutil.WriteFile(path, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+
+	want, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("%v (run with -update to create it)", err)
+	}
+	if !bytes.Equal(data, want) {
+		t.Errorf("output differs from %s:\ngot:\n%s\nwant:\n%s", path, data, want)
+	}
+}
+
+// goldenItem is the part of a PlaylistItem that parsing a page fills in.
+type goldenItem struct {
+	VideoID      string
+	Title        string
+	Duration     string
+	IsPlayable   bool
+	ThumbnailURL string
+}
+
+func goldenItems(items []*PlaylistItem) []goldenItem {
+	golden := make([]goldenItem, len(items))
+	for i, item := range items {
+		golden[i] = goldenItem{
+			VideoID:      item.VideoID,
+			Title:        item.Title,
+			Duration:     item.Duration.String(),
+			IsPlayable:   item.IsPlayable,
+			ThumbnailURL: item.ThumbnailURL,
+		}
+	}
+	return golden
+}
+
+func readPage(t *testing.T, name string) []byte {
+	return readTestData(t, filepath.Join("playlist", name))
+}
+
+func TestExtractInitialData(t *testing.T) {
+	tests := []struct {
+		name string
+		html string
+		want string
+	}{
+		{
+			name: "var",
+			html: `<script>var ytInitialData = {"a":1};</script>`,
+			want: `{"a":1}`,
+		},
+		{
+			name: "window",
+			html: `<script>window["ytInitialData"] = {"a":1};</script>`,
+			want: `{"a":1}`,
+		},
+		{
+			name: "script tag",
+			html: `<script id="ytInitialData" type="application/json">{"a":1}</script>`,
+			want: `{"a":1}`,
+		},
+		{
+			name: "mentioned in code first",
+			html: `<script>if (window.ytInitialData) { f({"b":2}); }</script><script>var ytInitialData = {"a":1};</script>`,
+			want: `{"a":1}`,
+		},
+		{
+			name: "truncated object",
+			html: `<script>var ytInitialData = {"a":`,
+		},
+		{
+			name: "declared without a value",
+			html: `<script>var ytInitialData; var x = {"a":1};</script>`,
+		},
+		{
+			name: "empty",
+			html: ``,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			data, err := extractInitialData([]byte(test.html))
+			if test.want == "" {
+				if err != ErrNoInitialData {
+					t.Errorf("err = %v, want ErrNoInitialData", err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("extractInitialData: %v", err)
+			}
+			if string(data) != test.want {
+				t.Errorf("data = %s, want %s", data, test.want)
+			}
+		})
+	}
+}
@@ -1,76 +1,158 @@
-package main
-
-import (
-	"time"
-
-	"github.com/rylio/ytdl"
-)
-
-type PlaylistInfo struct {
-	Title        string
-	Description  string
-	ThumbnailURL string
-	Items        []*PlaylistItem
-}
-
-type PlaylistItem struct {
-	VideoID      string
-	Title        string
-	Duration     time.Duration
-	IsPlayable   bool
-	ThumbnailURL string
-	VideoInfo    *ytdl.VideoInfo
-}
-
-type initialPlaylistData struct {
-	Contents struct {
-		TwoColumnBrowseResultsRenderer struct {
-			Tabs []struct {
-				TabRenderer struct {
-					Content struct {
-						SectionListRenderer struct {
-							Contents []struct {
-								ItemSectionRenderer struct {
-									Contents []struct {
-										PlaylistVideoListRenderer struct {
-											Contents []struct {
-												PlaylistVideoRenderer struct {
-													VideoID   string `json:"videoId"`
-													Thumbnail struct {
-														Thumbnails []struct {
-															URL    string `json:"url"`
-															Width  int    `json:"width"`
-															Height int    `json:"height"`
-														} `json:"thumbnails"`
-													} `json:"thumbnail"`
-													Title struct {
-														SimpleText string `json:"simpleText"`
-													} `json:"title"`
-													LengthSeconds int  `json:"lengthSeconds,string"`
-													IsPlayable    bool `json:"isPlayable"`
-												} `json:"playlistVideoRenderer"`
-											} `json:"contents"`
-										} `json:"playlistVideoListRenderer"`
-									} `json:"contents"`
-								} `json:"itemSectionRenderer"`
-							} `json:"contents"`
-						} `json:"sectionListRenderer"`
-					} `json:"content"`
-				} `json:"tabRenderer"`
-			} `json:"tabs"`
-		} `json:"twoColumnBrowseResultsRenderer"`
-	} `json:"contents"`
-	Microformat struct {
-		MicroformatDataRenderer struct {
-			Title       string `json:"title"`
-			Description string `json:"description"`
-			Thumbnail   struct {
-				Thumbnails []struct {
-					URL    string `json:"url"`
-					Width  int    `json:"width"`
-					Height int    `json:"height"`
-				} `json:"thumbnails"`
-			} `json:"thumbnail"`
-		} `json:"microformatDataRenderer"`
-	} `json:"microformat"`
-}
+package main
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rylio/ytdl"
+)
+
+type PlaylistInfo struct {
+	Title        string
+	Description  string
+	ThumbnailURL string
+	Items        []*PlaylistItem
+	// ItemCount is the size of the playlist as reported by the source, or 0
+	// if unknown. Items may be shorter when the playlist was cut off.
+	ItemCount int
+}
+
+type PlaylistItem struct {
+	EntryID      int
+	VideoID      string
+	Title        string
+	Duration     time.Duration
+	IsPlayable   bool
+	ThumbnailURL string
+	PageURL      string
+	// StartTime is where playback of the song begins, as given by a t=
+	// parameter on the link it was queued from.
+	StartTime   time.Duration
+	VideoInfo   *ytdl.VideoInfo
+	Source      Source
+	RequestedBy string
+
+	// mu serializes downloads and file access for this item between the
+	// playback loop and prefetch goroutines.
+	mu sync.Mutex
+
+	// download is the item's download, if any, and cacheName the song cache
+	// file it holds a reference to.
+	download  *progressiveDownload
+	cacheName string
+
+	// replayOf is the ID of the history entry the item was queued again
+	// from, if any.
+	replayOf int
+}
+
+type initialPlaylistData struct {
+	Header struct {
+		PlaylistHeaderRenderer struct {
+			NumVideosText formattedText   `json:"numVideosText"`
+			Stats         []formattedText `json:"stats"`
+		} `json:"playlistHeaderRenderer"`
+	} `json:"header"`
+	Microformat struct {
+		MicroformatDataRenderer struct {
+			Title       string `json:"title"`
+			Description string `json:"description"`
+			Thumbnail   struct {
+				Thumbnails []struct {
+					URL    string `json:"url"`
+					Width  int    `json:"width"`
+					Height int    `json:"height"`
+				} `json:"thumbnails"`
+			} `json:"thumbnail"`
+		} `json:"microformatDataRenderer"`
+	} `json:"microformat"`
+}
+
+// playlistVideoList is a page of playlist entries.
+type playlistVideoList struct {
+	Contents      []playlistVideoListContent `json:"contents"`
+	Continuations []playlistContinuation     `json:"continuations"`
+}
+
+// playlistVideoListContent is an entry of a playlist page. The last entry of
+// a page that is followed by more holds the continuation token instead of a
+// video.
+type playlistVideoListContent struct {
+	PlaylistVideoRenderer struct {
+		VideoID   string `json:"videoId"`
+		Thumbnail struct {
+			Thumbnails []struct {
+				URL    string `json:"url"`
+				Width  int    `json:"width"`
+				Height int    `json:"height"`
+			} `json:"thumbnails"`
+		} `json:"thumbnail"`
+		Title         formattedText `json:"title"`
+		LengthSeconds int           `json:"lengthSeconds,string"`
+		IsPlayable    bool          `json:"isPlayable"`
+	} `json:"playlistVideoRenderer"`
+	ContinuationItemRenderer struct {
+		ContinuationEndpoint struct {
+			ContinuationCommand struct {
+				Token string `json:"token"`
+			} `json:"continuationCommand"`
+		} `json:"continuationEndpoint"`
+	} `json:"continuationItemRenderer"`
+}
+
+// playlistContinuation is the older form of a continuation token, attached to
+// the list rather than appended to its entries.
+type playlistContinuation struct {
+	NextContinuationData struct {
+		Continuation string `json:"continuation"`
+	} `json:"nextContinuationData"`
+}
+
+// playlistContinuationData is the response to a request for the next page of
+// a playlist.
+type playlistContinuationData struct {
+	OnResponseReceivedActions []struct {
+		AppendContinuationItemsAction struct {
+			ContinuationItems []playlistVideoListContent `json:"continuationItems"`
+		} `json:"appendContinuationItemsAction"`
+	} `json:"onResponseReceivedActions"`
+	ContinuationContents struct {
+		PlaylistVideoListContinuation playlistVideoList `json:"playlistVideoListContinuation"`
+	} `json:"continuationContents"`
+}
+
+// searchVideoRenderer is a video in the search results.
+type searchVideoRenderer struct {
+	VideoID   string `json:"videoId"`
+	Thumbnail struct {
+		Thumbnails []struct {
+			URL    string `json:"url"`
+			Width  int    `json:"width"`
+			Height int    `json:"height"`
+		} `json:"thumbnails"`
+	} `json:"thumbnail"`
+	Title      formattedText `json:"title"`
+	OwnerText  formattedText `json:"ownerText"`
+	LengthText formattedText `json:"lengthText"`
+}
+
+// formattedText is text that YouTube sends either whole or split into runs.
+type formattedText struct {
+	SimpleText string `json:"simpleText"`
+	Runs       []struct {
+		Text string `json:"text"`
+	} `json:"runs"`
+}
+
+func (t formattedText) String() string {
+	if t.SimpleText != "" {
+		return t.SimpleText
+	}
+
+	var sb strings.Builder
+	for _, run := range t.Runs {
+		sb.WriteString(run.Text)
+	}
+	return sb.String()
+}
@@ -1,111 +1,300 @@
-package main
-
-import (
-	"encoding/json"
-	"fmt"
-	"io/ioutil"
-	"net/http"
-	"regexp"
-	"time"
-)
-
-var (
-	youtubeBaseURL            = "https://www.youtube.com/"
-	regexpInitialPlaylistData = regexp.MustCompile(`\["ytInitialData"\] = (.+);`)
-)
-
-func (c *Client) GetPlaylistInfoFromID(id string) (*PlaylistInfo, error) {
-	body, err := c.httpGetAndCheckResponseReadBody(youtubeBaseURL + "playlist?list=" + id)
-
-	if err != nil {
-		return nil, err
-	}
-	return getPlaylistInfoFromHTML(body)
-}
-
-func getPlaylistInfoFromHTML(html []byte) (*PlaylistInfo, error) {
-	if matches := regexpInitialPlaylistData.FindSubmatch(html); len(matches) > 0 {
-		data := initialPlaylistData{}
-
-		if err := json.Unmarshal(matches[1], &data); err != nil {
-			return nil, err
-		}
-
-		info := data.Microformat.MicroformatDataRenderer
-
-		playlistInfo := &PlaylistInfo{
-			Title:       info.Title,
-			Description: info.Description,
-		}
-
-		if len(info.Thumbnail.Thumbnails) > 0 {
-			playlistInfo.ThumbnailURL = info.Thumbnail.Thumbnails[0].URL
-		}
-
-		tabSection := data.Contents.TwoColumnBrowseResultsRenderer.Tabs[0]
-		sectionList := tabSection.TabRenderer.Content.SectionListRenderer.Contents[0]
-		itemSection := sectionList.ItemSectionRenderer.Contents[0]
-		playlistItems := itemSection.PlaylistVideoListRenderer.Contents
-
-		playlist := make([]*PlaylistItem, 0)
-
-		for _, item := range playlistItems {
-			vid := item.PlaylistVideoRenderer
-			p := &PlaylistItem{
-				VideoID:    vid.VideoID,
-				Title:      vid.Title.SimpleText,
-				Duration:   time.Duration(int64(vid.LengthSeconds) * int64(time.Second)),
-				IsPlayable: vid.IsPlayable,
-			}
-			if len(vid.Thumbnail.Thumbnails) > 0 {
-				p.ThumbnailURL = vid.Thumbnail.Thumbnails[0].URL
-			}
-			playlist = append(playlist, p)
-		}
-
-		playlistInfo.Items = playlist
-
-		return playlistInfo, nil
-	}
-
-	return nil, nil
-}
-
-func (c *Client) httpGet(url string) (*http.Response, error) {
-	req, err := http.NewRequest("GET", url, nil)
-
-	if err != nil {
-		return nil, err
-	}
-
-	// Youtube responses depend on language and user agent
-	req.Header.Set("Accept-Language", "en-US,en;q=0.5")
-	req.Header.Set("User-Agent", "Mozilla/5.0 (Windows NT 10.0; Win64; x64; rv:70.0) Gecko/20100101 Firefox/70.0")
-
-	return c.HTTPClient.Do(req)
-}
-
-func (c *Client) httpGetAndCheckResponse(url string) (*http.Response, error) {
-	resp, err := c.httpGet(url)
-	if err != nil {
-		return nil, fmt.Errorf("request failed: %w", err)
-	}
-
-	if resp.StatusCode != 200 {
-		resp.Body.Close()
-		return nil, fmt.Errorf("unexpected status code: %v", resp.StatusCode)
-	}
-
-	return resp, nil
-}
-
-func (c *Client) httpGetAndCheckResponseReadBody(url string) ([]byte, error) {
-	resp, err := c.httpGetAndCheckResponse(url)
-	if err != nil {
-		return nil, err
-	}
-
-	defer resp.Body.Close()
-
-	return ioutil.ReadAll(resp.Body)
-}
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const defaultInnertubeClientVersion = "2.20201021.03.00"
+
+var (
+	youtubeBaseURL                 = "https://www.youtube.com/"
+	regexpInnertubeAPIKey          = regexp.MustCompile(`"INNERTUBE_API_KEY":"([^"]+)"`)
+	regexpInnertubeClientVersion   = regexp.MustCompile(`"INNERTUBE_CLIENT_VERSION":"([^"]+)"`)
+	regexpPlaylistItemCountNumbers = regexp.MustCompile(`[0-9][0-9,.]*`)
+)
+
+// innertubeConfig holds what the page passes to YouTube's internal API, which
+// serves the continuation pages of a playlist.
+type innertubeConfig struct {
+	APIKey        string
+	ClientVersion string
+}
+
+// GetPlaylistInfoFromID loads a playlist, following its continuation pages
+// until every item is loaded or maxItems is reached. maxItems of 0 loads the
+// whole playlist. progress, if not nil, is called before each further page is
+// requested.
+func (c *Client) GetPlaylistInfoFromID(id string, maxItems int, progress ResolveProgress) (*PlaylistInfo, error) {
+	body, err := c.httpGetAndCheckResponseReadBody(youtubeBaseURL + "playlist?list=" + id)
+
+	if err != nil {
+		return nil, err
+	}
+
+	playlistInfo, continuation, err := getPlaylistInfoFromHTML(body)
+	if err != nil {
+		return nil, err
+	}
+
+	config := getInnertubeConfig(body)
+
+	// A page that repeats a token or adds nothing would otherwise be
+	// followed forever when there is no limit.
+	seen := make(map[string]bool)
+
+	for continuation != "" && !seen[continuation] && (maxItems <= 0 || len(playlistInfo.Items) < maxItems) {
+		if progress != nil {
+			progress(len(playlistInfo.Items), playlistInfo.ItemCount)
+		}
+		seen[continuation] = true
+
+		var items []*PlaylistItem
+		items, continuation, err = c.getPlaylistContinuation(config, continuation)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load playlist page: %w", err)
+		}
+		if len(items) == 0 {
+			break
+		}
+
+		playlistInfo.Items = append(playlistInfo.Items, items...)
+	}
+
+	if maxItems > 0 && len(playlistInfo.Items) > maxItems {
+		playlistInfo.Items = playlistInfo.Items[:maxItems]
+	}
+
+	return playlistInfo, nil
+}
+
+// getPlaylistInfoFromHTML parses the first page of a playlist. It also returns
+// the token for the next page, if there is one.
+func getPlaylistInfoFromHTML(html []byte) (*PlaylistInfo, string, error) {
+	raw, err := extractInitialData(html)
+	if err != nil {
+		return nil, "", err
+	}
+
+	data := initialPlaylistData{}
+	if err := json.Unmarshal(raw, &data); err != nil {
+		return nil, "", err
+	}
+
+	var tree interface{}
+	if err := json.Unmarshal(raw, &tree); err != nil {
+		return nil, "", err
+	}
+
+	lists := findRenderers(tree, "playlistVideoListRenderer")
+	if len(lists) == 0 {
+		if alert := findAlert(tree); alert != "" {
+			return nil, "", &UnavailableError{Reason: alert}
+		}
+		return nil, "", &LayoutError{Page: "playlist", Missing: "playlistVideoListRenderer"}
+	}
+
+	var videoList playlistVideoList
+	if err := decodeRenderer(lists[0], &videoList); err != nil {
+		return nil, "", err
+	}
+
+	info := data.Microformat.MicroformatDataRenderer
+
+	playlistInfo := &PlaylistInfo{
+		Title:       info.Title,
+		Description: info.Description,
+		ItemCount:   getPlaylistItemCount(&data),
+	}
+
+	if len(info.Thumbnail.Thumbnails) > 0 {
+		playlistInfo.ThumbnailURL = info.Thumbnail.Thumbnails[0].URL
+	}
+
+	items, continuation := getPlaylistItems(videoList.Contents, videoList.Continuations)
+	playlistInfo.Items = items
+
+	return playlistInfo, continuation, nil
+}
+
+// getPlaylistItems converts the entries of a playlist page and finds the
+// token for the next page.
+func getPlaylistItems(contents []playlistVideoListContent, continuations []playlistContinuation) ([]*PlaylistItem, string) {
+	playlist := make([]*PlaylistItem, 0)
+	continuation := ""
+
+	for _, item := range contents {
+		if token := item.ContinuationItemRenderer.ContinuationEndpoint.ContinuationCommand.Token; token != "" {
+			continuation = token
+			continue
+		}
+
+		vid := item.PlaylistVideoRenderer
+		if vid.VideoID == "" {
+			continue
+		}
+
+		p := &PlaylistItem{
+			VideoID:    vid.VideoID,
+			Title:      vid.Title.String(),
+			Duration:   time.Duration(int64(vid.LengthSeconds) * int64(time.Second)),
+			IsPlayable: vid.IsPlayable,
+		}
+		if len(vid.Thumbnail.Thumbnails) > 0 {
+			p.ThumbnailURL = vid.Thumbnail.Thumbnails[0].URL
+		}
+		playlist = append(playlist, p)
+	}
+
+	if continuation == "" && len(continuations) > 0 {
+		continuation = continuations[0].NextContinuationData.Continuation
+	}
+
+	return playlist, continuation
+}
+
+// getPlaylistItemCount reads the number of videos from the playlist header,
+// such as "742 videos".
+func getPlaylistItemCount(data *initialPlaylistData) int {
+	header := data.Header.PlaylistHeaderRenderer
+
+	text := header.NumVideosText.String()
+	if text == "" && len(header.Stats) > 0 {
+		text = header.Stats[0].String()
+	}
+
+	number := regexpPlaylistItemCountNumbers.FindString(text)
+	number = strings.NewReplacer(",", "", ".", "").Replace(number)
+
+	count, _ := strconv.Atoi(number)
+	return count
+}
+
+func getInnertubeConfig(html []byte) innertubeConfig {
+	config := innertubeConfig{
+		ClientVersion: defaultInnertubeClientVersion,
+	}
+
+	if matches := regexpInnertubeAPIKey.FindSubmatch(html); len(matches) > 0 {
+		config.APIKey = string(matches[1])
+	}
+	if matches := regexpInnertubeClientVersion.FindSubmatch(html); len(matches) > 0 {
+		config.ClientVersion = string(matches[1])
+	}
+
+	return config
+}
+
+// getPlaylistContinuation requests the playlist page for token.
+func (c *Client) getPlaylistContinuation(config innertubeConfig, token string) ([]*PlaylistItem, string, error) {
+	if config.APIKey == "" {
+		return nil, "", fmt.Errorf("no API key found on the playlist page")
+	}
+
+	request := map[string]interface{}{
+		"context": map[string]interface{}{
+			"client": map[string]interface{}{
+				"clientName":    "WEB",
+				"clientVersion": config.ClientVersion,
+				"hl":            "en",
+			},
+		},
+		"continuation": token,
+	}
+
+	body, err := c.httpPostJSONAndReadBody(youtubeBaseURL+"youtubei/v1/browse?key="+url.QueryEscape(config.APIKey), request)
+	if err != nil {
+		return nil, "", err
+	}
+
+	data := playlistContinuationData{}
+	if err := json.Unmarshal(body, &data); err != nil {
+		return nil, "", err
+	}
+
+	for _, action := range data.OnResponseReceivedActions {
+		if contents := action.AppendContinuationItemsAction.ContinuationItems; len(contents) > 0 {
+			items, continuation := getPlaylistItems(contents, nil)
+			return items, continuation, nil
+		}
+	}
+
+	videoList := data.ContinuationContents.PlaylistVideoListContinuation
+	items, continuation := getPlaylistItems(videoList.Contents, videoList.Continuations)
+	return items, continuation, nil
+}
+
+func (c *Client) httpGet(url string) (*http.Response, error) {
+	req, err := http.NewRequest("GET", url, nil)
+
+	if err != nil {
+		return nil, err
+	}
+
+	// Youtube responses depend on language and user agent
+	req.Header.Set("Accept-Language", "en-US,en;q=0.5")
+	req.Header.Set("User-Agent", "Mozilla/5.0 (Windows NT 10.0; Win64; x64; rv:70.0) Gecko/20100101 Firefox/70.0")
+
+	return c.HTTPClient.Do(req)
+}
+
+func (c *Client) httpPostJSONAndReadBody(url string, v interface{}) ([]byte, error) {
+	payload, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest("POST", url, bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept-Language", "en-US,en;q=0.5")
+	req.Header.Set("User-Agent", "Mozilla/5.0 (Windows NT 10.0; Win64; x64; rv:70.0) Gecko/20100101 Firefox/70.0")
+
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("unexpected status code: %v", resp.StatusCode)
+	}
+
+	return ioutil.ReadAll(resp.Body)
+}
+
+func (c *Client) httpGetAndCheckResponse(url string) (*http.Response, error) {
+	resp, err := c.httpGet(url)
+	if err != nil {
+		return nil, fmt.Errorf("request failed: %w", err)
+	}
+
+	if resp.StatusCode != 200 {
+		resp.Body.Close()
+		return nil, fmt.Errorf("unexpected status code: %v", resp.StatusCode)
+	}
+
+	return resp, nil
+}
+
+func (c *Client) httpGetAndCheckResponseReadBody(url string) ([]byte, error) {
+	resp, err := c.httpGetAndCheckResponse(url)
+	if err != nil {
+		return nil, err
+	}
+
+	defer resp.Body.Close()
+
+	return ioutil.ReadAll(resp.Body)
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+// playlistGolden is what getPlaylistInfoFromHTML and getInnertubeConfig read
+// from a playlist page.
+type playlistGolden struct {
+	Title        string       `json:",omitempty"`
+	Description  string       `json:",omitempty"`
+	ThumbnailURL string       `json:",omitempty"`
+	ItemCount    int          `json:",omitempty"`
+	Items        []goldenItem `json:",omitempty"`
+	Continuation string       `json:",omitempty"`
+	Config       innertubeConfig
+	Error        string `json:",omitempty"`
+}
+
+func TestGetPlaylistInfoFromHTML(t *testing.T) {
+	var (
+		layoutErr      *LayoutError
+		unavailableErr *UnavailableError
+	)
+
+	tests := []struct {
+		page string
+		// checkErr reports whether the error is the expected kind, or is nil
+		// if the page should parse.
+		checkErr func(error) bool
+	}{
+		{page: "var"},
+		{page: "window"},
+		{page: "script"},
+		{
+			page:     "alert",
+			checkErr: func(err error) bool { return errors.As(err, &unavailableErr) },
+		},
+		{
+			page:     "layout",
+			checkErr: func(err error) bool { return errors.As(err, &layoutErr) },
+		},
+		{
+			page:     "nodata",
+			checkErr: func(err error) bool { return err == ErrNoInitialData },
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.page, func(t *testing.T) {
+			html := readPage(t, test.page+".html")
+
+			info, continuation, err := getPlaylistInfoFromHTML(html)
+			golden := playlistGolden{
+				Continuation: continuation,
+				Config:       getInnertubeConfig(html),
+			}
+
+			if test.checkErr != nil {
+				if err == nil || !test.checkErr(err) {
+					t.Fatalf("err = %v (%T), want another kind of error", err, err)
+				}
+				golden.Error = err.Error()
+			} else if err != nil {
+				t.Fatalf("getPlaylistInfoFromHTML: %v", err)
+			} else {
+				golden.Title = info.Title
+				golden.Description = info.Description
+				golden.ThumbnailURL = info.ThumbnailURL
+				golden.ItemCount = info.ItemCount
+				golden.Items = goldenItems(info.Items)
+			}
+
+			checkGolden(t, filepath.Join("testdata", "playlist", test.page+".golden"), golden)
+		})
+	}
+}
+
+func TestGetPlaylistInfoFromIDStopsOnBadContinuation(t *testing.T) {
+	tests := []struct {
+		continuation string
+		want         int
+	}{
+		// The page hands back the token it was requested with.
+		{continuation: "continuation-repeat.json", want: 4},
+		// The page has a new token but no items.
+		{continuation: "continuation-empty.json", want: 3},
+	}
+
+	for _, test := range tests {
+		t.Run(test.continuation, func(t *testing.T) {
+			page := readPage(t, "var.html")
+			continuation := readPage(t, test.continuation)
+
+			var log requestLog
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path == "/playlist" {
+					w.Write(page)
+					return
+				}
+
+				// Fail rather than loop forever if the guard is broken.
+				log.add(r)
+				if len(log.get()) > 5 {
+					w.WriteHeader(http.StatusTooManyRequests)
+					return
+				}
+				w.Write(continuation)
+			}))
+			defer server.Close()
+			setYouTubeBaseURL(t, server.URL)
+
+			client := &Client{HTTPClient: http.DefaultClient}
+			info, err := client.GetPlaylistInfoFromID("PLtest", 0, nil)
+			if err != nil {
+				t.Fatalf("GetPlaylistInfoFromID: %v", err)
+			}
+
+			if n := len(log.get()); n != 1 {
+				t.Errorf("requested %v continuation pages, want 1", n)
+			}
+			if len(info.Items) != test.want {
+				t.Errorf("loaded %v items, want %v", len(info.Items), test.want)
+			}
+		})
+	}
+}
+
+func TestGetPlaylistInfoFromIDFollowsContinuations(t *testing.T) {
+	tests := []struct {
+		page         string
+		token        string
+		continuation string
+		want         []string
+	}{
+		// The playlistVideoListRenderer layout, whose token is in
+		// continuations and whose next page is a
+		// playlistVideoListContinuation.
+		{
+			page:         "window.html",
+			token:        "old-style-token",
+			continuation: "continuation-old.json",
+			want:         []string{"dQw4w9WgXcQ", "kJQP7kiw5Fk", "9bZkp7q19f0"},
+		},
+		// The continuationItemRenderer layout, whose next page is an
+		// appendContinuationItemsAction.
+		{
+			page:         "var.html",
+			token:        "4qmFsgJhEiRWTFBMdGVzdA",
+			continuation: "continuation-new.json",
+			want:         []string{"dQw4w9WgXcQ", "kJQP7kiw5Fk", "xxxxxxxxxxx", "9bZkp7q19f0"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.page, func(t *testing.T) {
+			page := readPage(t, test.page)
+			continuation := readPage(t, test.continuation)
+
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path == "/playlist" {
+					w.Write(page)
+					return
+				}
+
+				var request struct {
+					Continuation string `json:"continuation"`
+				}
+				if err := json.NewDecoder(r.Body).Decode(&request); err != nil || request.Continuation != test.token {
+					http.Error(w, "unexpected continuation "+request.Continuation, http.StatusBadRequest)
+					return
+				}
+				w.Write(continuation)
+			}))
+			defer server.Close()
+			setYouTubeBaseURL(t, server.URL)
+
+			client := &Client{HTTPClient: http.DefaultClient}
+			info, err := client.GetPlaylistInfoFromID("PLtest", 0, nil)
+			if err != nil {
+				t.Fatalf("GetPlaylistInfoFromID: %v", err)
+			}
+
+			var ids []string
+			for _, item := range info.Items {
+				ids = append(ids, item.VideoID)
+			}
+			if !equalStrings(ids, test.want) {
+				t.Errorf("items = %q, want %q", ids, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// SearchResult is a video found by a YouTube search.
+type SearchResult struct {
+	VideoID      string
+	Title        string
+	Channel      string
+	Duration     time.Duration
+	ThumbnailURL string
+}
+
+// Search returns up to limit videos matching query, best match first.
+func (c *Client) Search(query string, limit int) ([]*SearchResult, error) {
+	body, err := c.httpGetAndCheckResponseReadBody(youtubeBaseURL + "results?search_query=" + url.QueryEscape(query))
+	if err != nil {
+		return nil, err
+	}
+
+	results, err := getSearchResultsFromHTML(body)
+	if err != nil {
+		return nil, err
+	}
+
+	if limit > 0 && len(results) > limit {
+		results = results[:limit]
+	}
+
+	return results, nil
+}
+
+// getSearchResultsFromHTML parses the videos out of a search results page,
+// including those in shelves. Channels, playlists and other kinds of results
+// are skipped.
+func getSearchResultsFromHTML(html []byte) ([]*SearchResult, error) {
+	raw, err := extractInitialData(html)
+	if err != nil {
+		return nil, err
+	}
+
+	var tree interface{}
+	if err := json.Unmarshal(raw, &tree); err != nil {
+		return nil, err
+	}
+
+	// Skip the sidebar and anything else outside the list of results.
+	primary := findRenderers(tree, "primaryContents")
+	if len(primary) == 0 {
+		return nil, &LayoutError{Page: "search", Missing: "primaryContents"}
+	}
+
+	results := make([]*SearchResult, 0)
+	// Shelves such as "People also watched" can repeat a result.
+	seen := make(map[string]bool)
+
+	for _, node := range findRenderers(primary[0], "videoRenderer") {
+		var vid searchVideoRenderer
+		if err := decodeRenderer(node, &vid); err != nil || vid.VideoID == "" || seen[vid.VideoID] {
+			continue
+		}
+		seen[vid.VideoID] = true
+
+		result := &SearchResult{
+			VideoID: vid.VideoID,
+			Title:   vid.Title.String(),
+			Channel: vid.OwnerText.String(),
+		}
+
+		// Live streams have no length.
+		if length := vid.LengthText.String(); length != "" {
+			result.Duration, _ = parseTimestamp(length)
+		}
+
+		if thumbnails := vid.Thumbnail.Thumbnails; len(thumbnails) > 0 {
+			result.ThumbnailURL = thumbnails[len(thumbnails)-1].URL
+		}
+
+		results = append(results, result)
+	}
+
+	return results, nil
+}
+
+// YouTubeSearchSource queues the top YouTube search result for free text. It
+// is meant to be registered last, as it handles anything that is not a URL.
+type YouTubeSearchSource struct {
+	youtube *YouTubeSource
+	client  *Client
+}
+
+func NewYouTubeSearchSource(youtube *YouTubeSource, client *Client) *YouTubeSearchSource {
+	return &YouTubeSearchSource{
+		youtube: youtube,
+		client:  client,
+	}
+}
+
+func (s *YouTubeSearchSource) Name() string {
+	return "YouTube search"
+}
+
+func (s *YouTubeSearchSource) Handles(input string) bool {
+	if strings.TrimSpace(input) == "" {
+		return false
+	}
+
+	u, err := url.ParseRequestURI(input)
+	return err != nil || u.Scheme == ""
+}
+
+func (s *YouTubeSearchSource) Resolve(input string) (*PlaylistInfo, error) {
+	results, err := s.client.Search(input, 1)
+	if err != nil {
+		return nil, err
+	}
+	if len(results) == 0 {
+		return nil, fmt.Errorf("no videos found for %s", input)
+	}
+
+	return &PlaylistInfo{
+		Items: []*PlaylistItem{s.youtube.newSearchResultItem(results[0])},
+	}, nil
+}
+
+// Open is never called for queued songs, which belong to the YouTube source.
+func (s *YouTubeSearchSource) Open(item *PlaylistItem) (AudioStream, error) {
+	return s.youtube.Open(item)
+}
+
+// newSearchResultItem creates a queue entry for a search result. The video
+// info is fetched when the song is downloaded.
+func (s *YouTubeSource) newSearchResultItem(result *SearchResult) *PlaylistItem {
+	return &PlaylistItem{
+		VideoID:      result.VideoID,
+		Title:        result.Title,
+		Duration:     result.Duration,
+		IsPlayable:   true,
+		ThumbnailURL: result.ThumbnailURL,
+		PageURL:      youtubeWatchURL(result.VideoID),
+		Source:       s,
+	}
+}
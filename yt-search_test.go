@@ -0,0 +1,111 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// setYouTubeBaseURL sends YouTube page requests to a test server.
+func setYouTubeBaseURL(t *testing.T, url string) {
+	previous := youtubeBaseURL
+	youtubeBaseURL = url + "/"
+	t.Cleanup(func() {
+		youtubeBaseURL = previous
+	})
+}
+
+func TestGetSearchResultsFromHTML(t *testing.T) {
+	results, err := getSearchResultsFromHTML(readTestData(t, "search.html"))
+	if err != nil {
+		t.Fatalf("getSearchResultsFromHTML: %v", err)
+	}
+
+	// Only the videos in the results list are kept, including the one in the
+	// shelf that is not a repeat: the channel, the playlist and the video in
+	// the sidebar card are skipped.
+	var ids []string
+	for _, result := range results {
+		ids = append(ids, result.VideoID)
+	}
+	if want := []string{"fJ9rUzIMcZQ", "jfKfPfyJRdk", "A22oy8dFjqc", "HgzGwKwLmgM"}; !equalStrings(ids, want) {
+		t.Fatalf("results = %q, want %q", ids, want)
+	}
+
+	if live := results[1]; live.Duration != 0 {
+		t.Errorf("live result duration = %v, want 0", live.Duration)
+	}
+	if long := results[2]; long.Duration != time.Hour+2*time.Minute+3*time.Second {
+		t.Errorf("duration of %s = %v, want 1h2m3s", long.Title, long.Duration)
+	}
+
+	golden := make([]map[string]string, len(results))
+	for i, result := range results {
+		golden[i] = map[string]string{
+			"VideoID":      result.VideoID,
+			"Title":        result.Title,
+			"Channel":      result.Channel,
+			"Duration":     result.Duration.String(),
+			"ThumbnailURL": result.ThumbnailURL,
+		}
+	}
+	checkGolden(t, filepath.Join("testdata", "search.golden"), golden)
+}
+
+func TestGetSearchResultsFromHTMLWithoutResults(t *testing.T) {
+	_, err := getSearchResultsFromHTML([]byte(`<script>var ytInitialData = {"contents":{}};</script>`))
+	if _, ok := err.(*LayoutError); !ok {
+		t.Errorf("err = %v, want a *LayoutError", err)
+	}
+}
+
+func TestSearchAppliesLimit(t *testing.T) {
+	page := readTestData(t, "search.html")
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/results" || r.URL.Query().Get("search_query") != "queen & friends" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(page)
+	}))
+	defer server.Close()
+	setYouTubeBaseURL(t, server.URL)
+
+	client := &Client{HTTPClient: http.DefaultClient}
+
+	for _, test := range []struct {
+		limit int
+		want  int
+	}{
+		{limit: 1, want: 1},
+		{limit: 2, want: 2},
+		{limit: 10, want: 4},
+		{limit: 0, want: 4},
+	} {
+		results, err := client.Search("queen & friends", test.limit)
+		if err != nil {
+			t.Fatalf("Search with limit %v: %v", test.limit, err)
+		}
+		if len(results) != test.want {
+			t.Errorf("Search with limit %v returned %v results, want %v", test.limit, len(results), test.want)
+		}
+		if len(results) > 0 && results[0].VideoID != "fJ9rUzIMcZQ" {
+			t.Errorf("Search with limit %v returned %s first, want the best match", test.limit, results[0].VideoID)
+		}
+	}
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/rylio/ytdl"
+)
+
+// YouTubeSource plays videos and playlists from YouTube. Songs are downloaded
+// to the song cache and played while the download is in progress.
+type YouTubeSource struct {
+	client *Client
+	cache  *SongCache
+	// maxPlaylistItems limits how much of a playlist is loaded. 0 loads all.
+	maxPlaylistItems int
+}
+
+func NewYouTubeSource(client *Client, cache *SongCache, maxPlaylistItems int) *YouTubeSource {
+	return &YouTubeSource{
+		client:           client,
+		cache:            cache,
+		maxPlaylistItems: maxPlaylistItems,
+	}
+}
+
+func (s *YouTubeSource) Name() string {
+	return "YouTube"
+}
+
+func (s *YouTubeSource) Handles(input string) bool {
+	_, ok := parseYouTubeLink(input)
+	return ok
+}
+
+func (s *YouTubeSource) Resolve(input string) (*PlaylistInfo, error) {
+	return s.ResolveWithProgress(input, nil)
+}
+
+// ResolveWithProgress loads the video or playlist input links to. A link to a
+// video within a playlist queues the playlist starting at that video.
+func (s *YouTubeSource) ResolveWithProgress(input string, progress ResolveProgress) (*PlaylistInfo, error) {
+	link, ok := parseYouTubeLink(input)
+	if !ok {
+		return nil, fmt.Errorf("%s is not a YouTube link", input)
+	}
+
+	if link.PlaylistID != "" {
+		// Load enough of the playlist to still have the limit left after the
+		// songs before the start are dropped.
+		maxItems := s.maxPlaylistItems
+		if maxItems > 0 && link.Index > 1 {
+			maxItems += link.Index - 1
+		}
+
+		playlist, err := s.client.GetPlaylistInfoFromID(link.PlaylistID, maxItems, progress)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, item := range playlist.Items {
+			item.PageURL = youtubeWatchURL(item.VideoID)
+			item.Source = s
+		}
+
+		startPlaylistAt(playlist, link)
+		if s.maxPlaylistItems > 0 && len(playlist.Items) > s.maxPlaylistItems {
+			playlist.Items = playlist.Items[:s.maxPlaylistItems]
+		}
+
+		return playlist, nil
+	}
+
+	video, err := s.client.GetVideoInfo(link.VideoID)
+	if err == nil && video == nil {
+		err = fmt.Errorf("no video found at %s", input)
+	}
+	if err != nil {
+		// Something that only looks like an ID is left to the other
+		// sources, which will usually search for it.
+		if link.Bare {
+			return nil, fmt.Errorf("%w: %v", errNotHandled, err)
+		}
+		return nil, err
+	}
+
+	item := s.newPlaylistItem(video)
+	item.StartTime = link.StartTime
+
+	return &PlaylistInfo{
+		Items: []*PlaylistItem{item},
+	}, nil
+}
+
+// startPlaylistAt drops the songs before the video the link points at, found
+// by its ID or else by its index.
+func startPlaylistAt(playlist *PlaylistInfo, link *youtubeLink) {
+	start := -1
+	if link.VideoID != "" {
+		for i, item := range playlist.Items {
+			if item.VideoID == link.VideoID {
+				start = i
+				break
+			}
+		}
+	}
+	if start < 0 && link.Index > 0 && link.Index <= len(playlist.Items) {
+		start = link.Index - 1
+	}
+	if start < 0 {
+		return
+	}
+
+	playlist.Items = playlist.Items[start:]
+	if playlist.ItemCount > 0 {
+		playlist.ItemCount -= start
+	}
+
+	if playlist.Items[0].VideoID == link.VideoID {
+		playlist.Items[0].StartTime = link.StartTime
+	}
+}
+
+// Open starts playing the song while it is still downloading.
+func (s *YouTubeSource) Open(item *PlaylistItem) (AudioStream, error) {
+	download, err := startSongDownload(s.client, s.cache, item)
+	if err != nil {
+		return nil, err
+	}
+
+	return openDownload(download)
+}
+
+func (s *YouTubeSource) Prepare(item *PlaylistItem) error {
+	return PrepareSong(s.client, s.cache, item)
+}
+
+func (s *YouTubeSource) Release(item *PlaylistItem) error {
+	return RemoveSong(s.cache, item)
+}
+
+func (s *YouTubeSource) newPlaylistItem(video *ytdl.VideoInfo) *PlaylistItem {
+	return &PlaylistItem{
+		VideoID:      video.ID,
+		Title:        video.Title,
+		Duration:     video.Duration,
+		IsPlayable:   true,
+		ThumbnailURL: video.GetThumbnailURL(ytdl.ThumbnailQualityDefault).String(),
+		PageURL:      youtubeWatchURL(video.ID),
+		VideoInfo:    video,
+		Source:       s,
+	}
+}
+
+func youtubeWatchURL(videoID string) string {
+	return youtubeBaseURL + "watch?v=" + videoID
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/rylio/ytdl"
+)
+
+// fakeVideos is a VideoInfoProvider that knows a fixed set of videos, all of
+// whose formats download from downloadURL.
+type fakeVideos struct {
+	videos      map[string]*ytdl.VideoInfo
+	downloadURL string
+}
+
+func (v *fakeVideos) GetVideoInfo(id string) (*ytdl.VideoInfo, error) {
+	video, ok := v.videos[id]
+	if !ok {
+		return nil, errors.New("Unavailable because: Video unavailable")
+	}
+	return video, nil
+}
+
+func (v *fakeVideos) GetDownloadURL(info *ytdl.VideoInfo, format *ytdl.Format) (*url.URL, error) {
+	return url.Parse(v.downloadURL + "/videoplayback?id=" + info.ID)
+}
+
+// testVideo is a video with a single Opus audio format.
+func testVideo(id, title string) *ytdl.VideoInfo {
+	return &ytdl.VideoInfo{
+		ID:       id,
+		Title:    title,
+		Duration: time.Second,
+		Formats: ytdl.FormatList{
+			{Itag: ytdl.Itag{Number: 251, Extension: "webm", AudioEncoding: "opus", AudioBitrate: 160}},
+		},
+	}
+}
+
+func TestBareIDFallsBackToSearch(t *testing.T) {
+	page := readTestData(t, "search.html")
+	var log requestLog
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		log.add(r)
+		w.Write(page)
+	}))
+	defer server.Close()
+	setYouTubeBaseURL(t, server.URL)
+
+	client := &Client{
+		HTTPClient: http.DefaultClient,
+		Videos: &fakeVideos{videos: map[string]*ytdl.VideoInfo{
+			"dQw4w9WgXcQ": testVideo("dQw4w9WgXcQ", "Never Gonna Give You Up"),
+		}},
+	}
+	youtube := NewYouTubeSource(client, nil, 0)
+	sources := NewSourceRegistry(youtube, NewYouTubeSearchSource(youtube, client))
+
+	tests := []struct {
+		input    string
+		want     string
+		wantErr  bool
+		searches int
+	}{
+		// An 11 letter word is searched for once it is not found as a video.
+		{input: "radioactive", want: "fJ9rUzIMcZQ", searches: 1},
+		{input: "dQw4w9WgXcQ", want: "dQw4w9WgXcQ"},
+		// A link is never searched for, even if the video is missing.
+		{input: "https://youtu.be/xxxxxxxxxxx", wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.input, func(t *testing.T) {
+			before := len(log.get())
+
+			info, err := sources.Resolve(test.input)
+			if searches := len(log.get()) - before; searches != test.searches {
+				t.Errorf("made %v search requests, want %v", searches, test.searches)
+			}
+
+			if test.wantErr {
+				if err == nil {
+					t.Errorf("Resolve succeeded with %s, want an error", info.Items[0].VideoID)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Resolve: %v", err)
+			}
+
+			item := info.Items[0]
+			if item.VideoID != test.want {
+				t.Errorf("VideoID = %s, want %s", item.VideoID, test.want)
+			}
+			if item.Source != youtube {
+				t.Errorf("Source = %v, want the YouTube source", item.Source.Name())
+			}
+		})
+	}
+}
+
+func TestYouTubeSourceOpen(t *testing.T) {
+	videos := &fakeVideos{videos: map[string]*ytdl.VideoInfo{
+		"dQw4w9WgXcQ": testVideo("dQw4w9WgXcQ", "Never Gonna Give You Up"),
+	}}
+	cache := NewSongCache(tempDir(t), 1<<20)
+	source := NewYouTubeSource(newReplayClient(t, videos), cache, 0)
+
+	info, err := source.Resolve("dQw4w9WgXcQ")
+	if err != nil {
+		t.Fatalf("Resolve: %v", err)
+	}
+	item := info.Items[0]
+
+	stream, err := source.Open(item)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer stream.Close()
+
+	count := 0
+	var last time.Duration
+	for packet := range stream.Packets() {
+		count++
+		last = packet.Timecode
+	}
+
+	if err := stream.Err(); err != nil {
+		t.Fatalf("stream ended with %v", err)
+	}
+	if count != 50 || last != 980*time.Millisecond {
+		t.Errorf("got %v packets ending at %v, want 50 ending at 980ms", count, last)
+	}
+
+	cached, err := ioutil.ReadFile(cache.Path(getFileName(item)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(cached, readTestData(t, "tone.webm")) {
+		t.Error("the cached file differs from the one served")
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var regexpYouTubeID = regexp.MustCompile(`^[A-Za-z0-9_-]{11}$`)
+
+// youtubeLink is what a YouTube URL or bare video ID points at.
+type youtubeLink struct {
+	VideoID    string
+	PlaylistID string
+	// Index is the 1-based position of the video in the playlist, or 0 if the
+	// URL does not give one.
+	Index int
+	// StartTime is where playback of the video should begin.
+	StartTime time.Duration
+	// Bare is set when the input was only an ID, which may as well be an
+	// 11 letter search such as "radioactive".
+	Bare bool
+}
+
+// parseYouTubeLink classifies input as a link to a YouTube video, playlist,
+// or a video within a playlist. It understands watch, playlist, embed, shorts
+// and live URLs on youtube.com, m.youtube.com and music.youtube.com, youtu.be
+// short links, and bare 11 character video IDs.
+func parseYouTubeLink(input string) (*youtubeLink, bool) {
+	input = strings.TrimSpace(input)
+
+	if regexpYouTubeID.MatchString(input) {
+		return &youtubeLink{VideoID: input, Bare: true}, true
+	}
+
+	u, err := url.Parse(input)
+	if err != nil {
+		return nil, false
+	}
+
+	// Links pasted without a scheme parse as a bare path.
+	if u.Host == "" && u.Scheme == "" {
+		if u, err = url.Parse("https://" + input); err != nil {
+			return nil, false
+		}
+	}
+
+	query := u.Query()
+	link := &youtubeLink{
+		PlaylistID: query.Get("list"),
+		StartTime:  parseYouTubeStartTime(query),
+	}
+	link.Index, _ = strconv.Atoi(query.Get("index"))
+
+	switch strings.ToLower(u.Hostname()) {
+	case "www.youtube.com", "youtube.com", "m.youtube.com", "music.youtube.com", "www.youtube-nocookie.com", "youtube-nocookie.com":
+		segments := strings.Split(strings.Trim(u.Path, "/"), "/")
+
+		switch segments[0] {
+		case "watch":
+			link.VideoID = query.Get("v")
+		case "playlist":
+		case "embed", "shorts", "live", "v":
+			if len(segments) > 1 {
+				link.VideoID = segments[1]
+			}
+		default:
+			return nil, false
+		}
+	case "youtu.be":
+		link.VideoID = strings.Trim(u.Path, "/")
+	default:
+		return nil, false
+	}
+
+	if link.VideoID != "" && !regexpYouTubeID.MatchString(link.VideoID) {
+		return nil, false
+	}
+	if link.VideoID == "" && link.PlaylistID == "" {
+		return nil, false
+	}
+
+	return link, true
+}
+
+// parseYouTubeStartTime reads the t or start parameter, which may be plain
+// seconds or a duration such as 1m30s.
+func parseYouTubeStartTime(query url.Values) time.Duration {
+	value := query.Get("t")
+	if value == "" {
+		value = query.Get("start")
+	}
+	if value == "" {
+		return 0
+	}
+
+	start, err := parseTimestamp(value)
+	if err != nil {
+		return 0
+	}
+	return start
+}
+
+// VideoURL links to the video alone, without the playlist.
+func (l *youtubeLink) VideoURL() string {
+	u := youtubeWatchURL(l.VideoID)
+	if l.StartTime > 0 {
+		u += "&t=" + strconv.Itoa(int(l.StartTime/time.Second))
+	}
+	return u
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseYouTubeLink(t *testing.T) {
+	tests := []struct {
+		input string
+		want  *youtubeLink
+	}{
+		{
+			input: "dQw4w9WgXcQ",
+			want:  &youtubeLink{VideoID: "dQw4w9WgXcQ", Bare: true},
+		},
+		{
+			input: "https://youtu.be/dQw4w9WgXcQ",
+			want:  &youtubeLink{VideoID: "dQw4w9WgXcQ"},
+		},
+		{
+			input: "https://youtu.be/dQw4w9WgXcQ?t=42",
+			want:  &youtubeLink{VideoID: "dQw4w9WgXcQ", StartTime: 42 * time.Second},
+		},
+		{
+			input: "https://www.youtube.com/watch?v=dQw4w9WgXcQ",
+			want:  &youtubeLink{VideoID: "dQw4w9WgXcQ"},
+		},
+		{
+			input: "youtube.com/watch?v=dQw4w9WgXcQ",
+			want:  &youtubeLink{VideoID: "dQw4w9WgXcQ"},
+		},
+		{
+			input: "https://www.youtube.com/watch?v=dQw4w9WgXcQ&list=PLtest&index=3",
+			want:  &youtubeLink{VideoID: "dQw4w9WgXcQ", PlaylistID: "PLtest", Index: 3},
+		},
+		{
+			input: "https://www.youtube.com/playlist?list=PLtest",
+			want:  &youtubeLink{PlaylistID: "PLtest"},
+		},
+		{
+			input: "https://www.youtube.com/shorts/dQw4w9WgXcQ",
+			want:  &youtubeLink{VideoID: "dQw4w9WgXcQ"},
+		},
+		{
+			input: "https://www.youtube.com/embed/dQw4w9WgXcQ?start=90",
+			want:  &youtubeLink{VideoID: "dQw4w9WgXcQ", StartTime: 90 * time.Second},
+		},
+		{
+			input: "https://m.youtube.com/watch?v=dQw4w9WgXcQ&t=1m30s",
+			want:  &youtubeLink{VideoID: "dQw4w9WgXcQ", StartTime: 90 * time.Second},
+		},
+		{
+			input: "https://music.youtube.com/watch?v=dQw4w9WgXcQ&list=RDAMVMdQw4w9WgXcQ",
+			want:  &youtubeLink{VideoID: "dQw4w9WgXcQ", PlaylistID: "RDAMVMdQw4w9WgXcQ"},
+		},
+		{
+			input: "https://music.youtube.com/playlist?list=PLtest",
+			want:  &youtubeLink{PlaylistID: "PLtest"},
+		},
+		// A malformed start time is ignored rather than rejecting the link.
+		{
+			input: "https://www.youtube.com/watch?v=dQw4w9WgXcQ&t=soon",
+			want:  &youtubeLink{VideoID: "dQw4w9WgXcQ"},
+		},
+		{input: "https://vimeo.com/123456789"},
+		{input: "https://example.com/watch?v=dQw4w9WgXcQ"},
+		{input: "https://www.youtube.com/channel/UCuAXFkgsw1L7xaCfnd5JJOw"},
+		{input: "https://www.youtube.com/watch?v=short"},
+		{input: "https://www.youtube.com/watch"},
+		{input: "never gonna give you up"},
+		{input: ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.input, func(t *testing.T) {
+			link, ok := parseYouTubeLink(test.input)
+			if test.want == nil {
+				if ok {
+					t.Errorf("parsed %+v, want no link", link)
+				}
+				return
+			}
+
+			if !ok {
+				t.Fatal("not parsed as a link")
+			}
+			if *link != *test.want {
+				t.Errorf("link = %+v, want %+v", link, test.want)
+			}
+		})
+	}
+}